@@ -61,6 +61,12 @@ function App() {
       cleanUp();
     });
 
+    socket.on("matchError", (message) => {
+      console.error("[socket] matchError", message);
+      toast.error(message);
+      cleanUp();
+    });
+
     socket.on("downloadStatus", (payload) => {
       const msg = JSON.parse(payload);
       if (["info", "success", "error"].includes(msg.type))
@@ -194,13 +200,16 @@ function App() {
             return;
           }
 
-          const fp = result.data.reduce((d, i) => {
-            d[i.address] = i.anchorTime;
-            return d;
-          }, {});
+          const fp = result.data.map((i) => ({
+            address: i.address,
+            anchorTime: i.anchorTime,
+          }));
 
           if (sendRecordingRef.current)
-            emitWithLog("newFingerprint", JSON.stringify({ fingerprint: fp }));
+            emitWithLog(
+              "newFingerprint",
+              JSON.stringify({ fingerprint: fp, configId: result.configId })
+            );
 
           if (uploadRecording) {
             const bytes = new Uint8Array(ab);
@@ -212,7 +221,7 @@ function App() {
             const recordData = {
               audio: btoa(raw),
               channels: view.getUint16(22, true),
-              sampleRate: view.getUint16(24, true),
+              sampleRate: view.getUint32(24, true),
               sampleSize: view.getUint16(34, true),
               duration: decoded.duration,
             };
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"shazam/db"
+	waveid "shazam/process"
+)
+
+const catalogUsage = `Usage:
+  main.go catalog export <bundle.zip>
+  main.go catalog import <bundle.zip>`
+
+// manageCatalog runs the catalog subcommand given in args.
+func manageCatalog(args []string) {
+	if len(args) < 2 {
+		fmt.Println(catalogUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "export":
+		withStore(func(store db.FingerprintStore) error {
+			exportCatalog(store, args[1])
+			return nil
+		})
+	case "import":
+		withStore(func(store db.FingerprintStore) error {
+			importCatalog(store, args[1])
+			return nil
+		})
+	default:
+		fmt.Println(catalogUsage)
+		os.Exit(1)
+	}
+}
+
+// exportCatalog writes the whole catalog to a bundle at path. The bundle is
+// written next to path first, so a failed export leaves no partial file.
+func exportCatalog(dbClient db.FingerprintStore, path string) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		fmt.Println("Error creating bundle:", err)
+		return
+	}
+
+	manifest, err := waveid.ExportCatalog(dbClient, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fmt.Println("Error exporting catalog:", err)
+		return
+	}
+
+	fmt.Printf("Exported %d songs and %d fingerprints with config %s to %s\n",
+		manifest.Songs, manifest.Fingerprints, manifest.ConfigID, path)
+}
+
+// importCatalog merges the bundle at path into the catalog. The bundle must
+// have been made with the current fingerprint config. Songs imported before
+// an error are kept; importing the same bundle again adds the rest.
+func importCatalog(dbClient db.FingerprintStore, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Error opening bundle:", err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Println("Error opening bundle:", err)
+		return
+	}
+
+	result, err := waveid.ImportCatalog(dbClient, fpConfig, f, info.Size())
+	fmt.Printf("Imported %d songs (%d with a new ID) and %d fingerprints, skipped %d songs already in the catalog\n",
+		result.Imported, result.Remapped, result.Fingerprints, result.Skipped)
+	if err != nil {
+		fmt.Println("Error importing catalog:", err)
+	}
+}
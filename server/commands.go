@@ -12,9 +12,9 @@ import (
 	"shazam/db"
 	waveid "shazam/process"
 	"shazam/types"
-	"shazam/utils"
 	"strings"
 	"sync"
+	"time"
 
 	socketio "github.com/googollee/go-socket.io"
 	"github.com/googollee/go-socket.io/engineio"
@@ -23,32 +23,35 @@ import (
 	"github.com/googollee/go-socket.io/engineio/transport/websocket"
 )
 
-func find(filePath string) {
-	wavFilePath, err := utils.ConvertToWAV(filePath)
-	if err != nil {
-		fmt.Println("Error converting to WAV:", err)
-		return
-	}
-
-	fingerprint, err := waveid.Fingerprint(wavFilePath, utils.GenerateUniqueID())
-	if err != nil {
-		fmt.Println("Error generating fingerprint for sample: ", err)
-		return
-	}
-
-	sampleFingerprint := make(map[uint32]uint32)
-	for address, couple := range fingerprint {
-		sampleFingerprint[address] = couple.AnchorTimeMs
+// find identifies the song in filePath. With scale.MaxChange above zero it
+// also tries sped-up, slowed-down and pitch-shifted versions of the query.
+// With verbose set the diagnostics of every listed match are printed.
+func find(dbClient db.FingerprintStore, filePath string, opts waveid.MatchOptions, scale waveid.ScaleOptions, verbose bool) {
+	var matches []types.Match
+	var searchDuration time.Duration
+	var err error
+	if scale.MaxChange > 0 {
+		var peaks []waveid.Peak
+		if peaks, err = waveid.Peaks(filePath, fpConfig); err != nil {
+			fmt.Println("Error generating fingerprint for sample: ", err)
+			return
+		}
+		matches, searchDuration, err = waveid.FindMatchesScaled(dbClient, peaks, fpConfig, opts, scale)
+	} else {
+		var fingerprint []types.Hash
+		if fingerprint, err = waveid.Fingerprint(filePath, fpConfig); err != nil {
+			fmt.Println("Error generating fingerprint for sample: ", err)
+			return
+		}
+		matches, searchDuration, err = waveid.FindMatchesFGP(dbClient, fingerprint, fpConfig, opts)
 	}
-
-	matches, searchDuration, err := waveid.FindMatchesFGP(sampleFingerprint)
 	if err != nil {
 		fmt.Println("Error finding matches:", err)
 		return
 	}
 
 	if len(matches) == 0 {
-		fmt.Println("\nNo match found.")
+		fmt.Printf("\nNo match found with confidence of at least %.2f.\n", opts.Threshold)
 		fmt.Printf("\nSearch took: %s\n", searchDuration)
 		return
 	}
@@ -62,30 +65,57 @@ func find(filePath string) {
 
 	fmt.Println(msg)
 	for _, match := range topMatches {
-		fmt.Printf("\t- %s by %s, score: %.2f\n",
-			match.SongTitle, match.SongArtist, match.Score)
+		fmt.Printf("\t- %s by %s at %s%s, score: %.2f, confidence: %.2f\n",
+			match.SongTitle, match.SongArtist, formatPosition(match.Timestamp), formatScale(match), match.Score, match.Confidence)
+		if verbose {
+			fmt.Printf("\t  hits: %d/%d (%d stop hashes skipped), best bin: %d, runner-up bin: %d, span: %s, coverage: %.1f%%\n",
+				match.HashHits, match.QueryHashes, match.SkippedHashes, match.BestBinCount, match.RunnerUpBinCount,
+				formatPosition(match.MatchedSpanMs), match.Coverage*100)
+		}
 	}
 
 	fmt.Printf("\nSearch took: %s\n", searchDuration)
 	topMatch := topMatches[0]
-	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f\n",
-		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score)
+	label := "Final prediction"
+	if opts.Threshold == 0 {
+		label = "Best candidate"
+	}
+	fmt.Printf("\n%s: %s by %s at %s%s, score: %.2f, confidence: %.2f\n",
+		label, topMatch.SongTitle, topMatch.SongArtist, formatPosition(topMatch.Timestamp), formatScale(topMatch), topMatch.Score, topMatch.Confidence)
 }
 
-func download(path string) {
+// formatScale describes the speed and pitch of a match found by a scale
+// search, and is empty for a query played unchanged.
+func formatScale(match types.Match) string {
+	if match.SpeedFactor == 1 && match.PitchFactor == 1 {
+		return ""
+	}
+	return fmt.Sprintf(" (speed %.2fx, pitch %.2fx)", match.SpeedFactor, match.PitchFactor)
+}
+
+// formatPosition renders a position in milliseconds as m:ss.mmm.
+func formatPosition(ms uint32) string {
+	return fmt.Sprintf("%d:%02d.%03d", ms/60000, ms/1000%60, ms%1000)
+}
+
+func download(dbClient db.FingerprintStore, path string) {
 	if err := os.MkdirAll(SONGS_DIR, 0755); err != nil {
 		panic(err)
 	}
+	if err := checkConfig(dbClient); err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	if _, err := os.Stat(path); err == nil {
-		downloadFromJSON(path)
+		downloadFromJSON(dbClient, path)
 		return
 	}
 
 	downloadFromYTDLP(path)
 }
 
-func downloadFromJSON(path string) {
+func downloadFromJSON(dbClient db.FingerprintStore, path string) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		panic(err)
@@ -107,27 +137,9 @@ func downloadFromJSON(path string) {
 			defer func() { <-sem }()
 
 			meta := runYTDLP(query)
+			process(dbClient, meta.Filename, songFromYTMeta(meta))
 
-			artist := meta.Artist
-			if artist == "" {
-				artist = meta.Uploader
-			}
-
-			process(
-				meta.Filename,
-				meta.Title,
-				artist,
-				meta.ID,
-			)
-
-			wd, err := os.Getwd()
-			if err != nil {
-				panic(err)
-			}
-
-			p := filepath.Join(wd, strings.TrimSuffix(meta.Filename, filepath.Ext(meta.Filename))+".wav")
-
-			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			if err := os.Remove(meta.Filename); err != nil && !os.IsNotExist(err) {
 				panic(err)
 			}
 
@@ -137,6 +149,41 @@ func downloadFromJSON(path string) {
 	wg.Wait()
 }
 
+// songFromYTMeta describes the song of a yt-dlp download.
+func songFromYTMeta(meta types.YTMeta) types.Song {
+	song := types.Song{
+		Title:     meta.Title,
+		Artist:    meta.Artist,
+		YouTubeID: meta.ID,
+		SongMetadata: types.SongMetadata{
+			Album:       meta.Album,
+			DurationMs:  uint32(meta.Duration * 1000),
+			ReleaseYear: meta.ReleaseYear,
+			Genre:       meta.Genre,
+			Source:      meta.WebpageURL,
+		},
+	}
+	if song.Artist == "" {
+		song.Artist = meta.Uploader
+	}
+
+	tags := map[string]string{}
+	for key, value := range map[string]string{
+		"track":      meta.Track,
+		"uploader":   meta.Uploader,
+		"channel":    meta.Channel,
+		"uploadDate": meta.UploadDate,
+	} {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+	if len(tags) > 0 {
+		song.Tags = tags
+	}
+	return song
+}
+
 func runYTDLP(query string) types.YTMeta {
 	out := filepath.Join(SONGS_DIR, "%(title)s.%(ext)s")
 
@@ -183,25 +230,86 @@ func downloadFromYTDLP(input string) {
 	}
 }
 
-func process(filePath, songTitle, songArtist, ytID string) {
-	dbClient, err := db.DBClient(DB_PATH)
-	if err != nil {
-		panic(err)
+// checkConfig makes sure the database was built with fpConfig, recording it
+// when the database is still empty. It runs once before any songs are added.
+func checkConfig(dbClient db.FingerprintStore) error {
+	return waveid.CheckConfig(dbClient, fpConfig, true)
+}
+
+// showConfig prints the active fingerprint config and the one the database
+// was built with.
+func showConfig(dbClient db.FingerprintStore) {
+	active, _ := json.MarshalIndent(fpConfig, "", "  ")
+	fmt.Printf("Active config %s:\n%s\n", fpConfig.ID(), active)
+
+	stored, ok, err := waveid.StoredConfig(dbClient)
+	switch {
+	case err != nil:
+		fmt.Println("Error reading stored config:", err)
+	case !ok:
+		fmt.Println("\nThe database has no stored config.")
+	case stored.ID() == fpConfig.ID():
+		fmt.Println("\nThe database was built with the active config.")
+	default:
+		b, _ := json.MarshalIndent(stored, "", "  ")
+		fmt.Printf("\nThe database was built with config %s:\n%s\n", stored.ID(), b)
 	}
-	defer dbClient.Close()
+}
 
-	songID, err := dbClient.RegisterSong(songTitle, songArtist, ytID)
+// comparePeakPickers runs every peak picker over the same file and prints
+// how many peaks and hashes each one produces.
+func comparePeakPickers(filePath string) {
+	fmt.Printf("%-14s %8s %10s %8s\n", "picker", "peaks", "peaks/sec", "hashes")
+	for _, picker := range waveid.PeakPickers {
+		cfg := fpConfig
+		cfg.PeakPicker = picker
+
+		start := time.Now()
+		peaks, err := waveid.Peaks(filePath, cfg)
+		if err != nil {
+			fmt.Printf("Error picking peaks with %s: %v\n", picker, err)
+			return
+		}
+		elapsed := time.Since(start)
+
+		var duration float64
+		if len(peaks) > 0 {
+			duration = peaks[len(peaks)-1].Time
+		}
+		var rate float64
+		if duration > 0 {
+			rate = float64(len(peaks)) / duration
+		}
+		hashes := waveid.Extract(peaks, cfg)
+
+		fmt.Printf("%-14s %8d %10.1f %8d   (%s)\n", picker, len(peaks), rate, len(hashes), elapsed)
+	}
+}
+
+// process fingerprints the file at filePath and stores it as song.
+func process(dbClient db.FingerprintStore, filePath string, song types.Song) {
+	fingerprint, durationMs, err := waveid.FingerprintFile(filePath, fpConfig)
 	if err != nil {
 		panic(err)
 	}
-	fingerprint, err := waveid.Fingerprint(filePath, songID)
+	if song.DurationMs == 0 {
+		song.DurationMs = durationMs
+	}
+	songID, err := dbClient.RegisterSong(song)
 	if err != nil {
 		panic(err)
 	}
-	err = dbClient.StoreFingerprints(fingerprint)
+	if err := dbClient.StoreFingerprints(songID, fingerprint); err != nil {
+		// A song without fingerprints would block the next attempt to
+		// ingest it by its song key.
+		if delErr := dbClient.DeleteSong(songID); delErr != nil {
+			panic(fmt.Errorf("%v (cleanup failed: %v)", err, delErr))
+		}
+		panic(err)
+	}
 }
 
-func serve(protocol, port string) {
+func serve(dbClient db.FingerprintStore, protocol, port string, opts waveid.MatchOptions) {
 	protocol = strings.ToLower(protocol)
 	var allowOriginFunc = func(r *http.Request) bool {
 		return true
@@ -225,10 +333,14 @@ func serve(protocol, port string) {
 		return nil
 	})
 
-	server.OnEvent("/", "totalSongs", handleTotalSongs)
+	server.OnEvent("/", "totalSongs", func(socket socketio.Conn) {
+		handleTotalSongs(socket, dbClient)
+	})
 	server.OnEvent("/", "newDownload", handleSongDownload)
 	server.OnEvent("/", "newRecording", handleNewRecording)
-	server.OnEvent("/", "newFingerprint", handleNewFingerprint)
+	server.OnEvent("/", "newFingerprint", func(socket socketio.Conn, fingerprintData string) {
+		handleNewFingerprint(socket, fingerprintData, dbClient, opts)
+	})
 
 	server.OnError("/", func(s socketio.Conn, e error) {
 		log.Println("meet error:", e)
@@ -0,0 +1,506 @@
+//go:build !js
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"shazam/types"
+	"shazam/utils"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of a bolt store. Integers in keys are big-endian so keys sort
+// numerically.
+var (
+	// songsBucket maps songID to the JSON encoded song.
+	songsBucket = []byte("songs")
+	// songKeysBucket maps a song key to its songID.
+	songKeysBucket = []byte("songKeys")
+	// fingerprintsBucket holds empty values under address|songID|anchorTimeMs.
+	fingerprintsBucket = []byte("fingerprints")
+	// songFingerprintsBucket holds empty values under songID|address|anchorTimeMs.
+	songFingerprintsBucket = []byte("songFingerprints")
+	// countersBucket holds the song and fingerprint counts.
+	countersBucket = []byte("counters")
+	metadataBucket = []byte("metadata")
+	// addressFrequenciesBucket maps an address to the number of songs it
+	// occurs in.
+	addressFrequenciesBucket = []byte("addressFrequencies")
+
+	songCountKey        = []byte("songs")
+	fingerprintCountKey = []byte("fingerprints")
+)
+
+// BoltStore keeps the catalog in a single bbolt file, an embedded
+// key-value store written in pure Go.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var _ FingerprintStore = (*BoltStore)(nil)
+
+// openBolt opens the bolt store at path for Open.
+func openBolt(path string) (FingerprintStore, error) {
+	store, err := BoltClient(path)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func BoltClient(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening bolt store: %s", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		counted := tx.Bucket(addressFrequenciesBucket) != nil
+		for _, name := range [][]byte{songsBucket, songKeysBucket, fingerprintsBucket,
+			songFingerprintsBucket, countersBucket, metadataBucket, addressFrequenciesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if counted {
+			return nil
+		}
+		return countAddressFrequencies(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating buckets: %s", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+func be32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func key3(a, b, c uint32) []byte {
+	k := make([]byte, 12)
+	binary.BigEndian.PutUint32(k[0:], a)
+	binary.BigEndian.PutUint32(k[4:], b)
+	binary.BigEndian.PutUint32(k[8:], c)
+	return k
+}
+
+// hasKey reports whether key exists; Get cannot tell an empty value from a
+// missing key.
+func hasKey(bucket *bolt.Bucket, key []byte) bool {
+	k, _ := bucket.Cursor().Seek(key)
+	return bytes.Equal(k, key)
+}
+
+func addCounter(tx *bolt.Tx, key []byte, delta int) error {
+	counters := tx.Bucket(countersBucket)
+	var n int64
+	if v := counters.Get(key); v != nil {
+		n = int64(binary.BigEndian.Uint64(v))
+	}
+	return counters.Put(key, binary.BigEndian.AppendUint64(nil, uint64(n+int64(delta))))
+}
+
+// countAddressFrequencies fills the address frequencies of stores from
+// before the bucket existed.
+func countAddressFrequencies(tx *bolt.Tx) error {
+	frequencies := tx.Bucket(addressFrequenciesBucket)
+	c := tx.Bucket(fingerprintsBucket).Cursor()
+
+	// Keys are sorted by address, then song.
+	var address, songs, lastSong uint32
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		a, song := binary.BigEndian.Uint32(k), binary.BigEndian.Uint32(k[4:])
+		if songs > 0 && a != address {
+			if err := frequencies.Put(be32(address), be32(songs)); err != nil {
+				return err
+			}
+			songs = 0
+		}
+		if songs == 0 || song != lastSong {
+			songs++
+		}
+		address, lastSong = a, song
+	}
+	if songs > 0 {
+		return frequencies.Put(be32(address), be32(songs))
+	}
+	return nil
+}
+
+// addFrequency adds delta to the number of songs address occurs in.
+func addFrequency(tx *bolt.Tx, address uint32, delta int) error {
+	frequencies := tx.Bucket(addressFrequenciesBucket)
+	var n int
+	if v := frequencies.Get(be32(address)); v != nil {
+		n = int(binary.BigEndian.Uint32(v))
+	}
+	if n += delta; n <= 0 {
+		return frequencies.Delete(be32(address))
+	}
+	return frequencies.Put(be32(address), be32(uint32(n)))
+}
+
+func (b *BoltStore) counter(key []byte) (int, error) {
+	var n int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(countersBucket).Get(key); v != nil {
+			n = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (b *BoltStore) RegisterSong(song types.Song) (uint32, error) {
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	var songID uint32
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(songKeysBucket)
+		if keys.Get([]byte(songKey)) != nil {
+			return fmt.Errorf("%w: %s", ErrSongExists, songKey)
+		}
+
+		songs := tx.Bucket(songsBucket)
+		songID = song.ID
+		for songID == 0 || songs.Get(be32(songID)) != nil {
+			songID = utils.GenerateUniqueID()
+		}
+
+		song.ID = songID
+		if song.IngestedAt.IsZero() {
+			song.IngestedAt = time.Now().UTC()
+		}
+		data, err := json.Marshal(song)
+		if err != nil {
+			return err
+		}
+		if err := songs.Put(be32(songID), data); err != nil {
+			return err
+		}
+		if err := keys.Put([]byte(songKey), be32(songID)); err != nil {
+			return err
+		}
+		return addCounter(tx, songCountKey, 1)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to register song: %w", err)
+	}
+	return songID, nil
+}
+
+func (b *BoltStore) SongExists(songKey string) (bool, error) {
+	var exists bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(songKeysBucket).Get([]byte(songKey)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+func (b *BoltStore) GetSongByID(songID uint32) (types.Song, bool, error) {
+	var song types.Song
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(songsBucket).Get(be32(songID))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &song)
+	})
+	if err != nil {
+		return song, false, fmt.Errorf("error querying song by ID: %s", err)
+	}
+	return song, found, nil
+}
+
+func (b *BoltStore) ListSongs() ([]types.Song, error) {
+	var songs []types.Song
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(songsBucket).ForEach(func(_, data []byte) error {
+			var song types.Song
+			if err := json.Unmarshal(data, &song); err != nil {
+				return err
+			}
+			songs = append(songs, song)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying songs: %s", err)
+	}
+	slices.SortFunc(songs, compareSongs)
+	return songs, nil
+}
+
+func (b *BoltStore) FindSongs(query SongQuery) ([]types.Song, int, error) {
+	songs, err := b.ListSongs()
+	if err != nil {
+		return nil, 0, err
+	}
+	songs, total := filterSongs(songs, query)
+	return songs, total, nil
+}
+
+func (b *BoltStore) SongFingerprintCount(songID uint32) (int, error) {
+	count := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := be32(songID)
+		c := tx.Bucket(songFingerprintsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error counting fingerprints: %s", err)
+	}
+	return count, nil
+}
+
+func (b *BoltStore) UpdateSong(song types.Song) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		songs := tx.Bucket(songsBucket)
+		data := songs.Get(be32(song.ID))
+		if data == nil {
+			return fmt.Errorf("%w: %d", ErrSongNotFound, song.ID)
+		}
+		var old types.Song
+		if err := json.Unmarshal(data, &old); err != nil {
+			return err
+		}
+
+		keys := tx.Bucket(songKeysBucket)
+		songKey := []byte(utils.GenerateSongKey(song.Title, song.Artist))
+		if id := keys.Get(songKey); id != nil && binary.BigEndian.Uint32(id) != song.ID {
+			return fmt.Errorf("%w: %s", ErrSongExists, songKey)
+		}
+		if err := keys.Delete([]byte(utils.GenerateSongKey(old.Title, old.Artist))); err != nil {
+			return err
+		}
+		if err := keys.Put(songKey, be32(song.ID)); err != nil {
+			return err
+		}
+
+		song.IngestedAt = old.IngestedAt
+		data, err := json.Marshal(song)
+		if err != nil {
+			return err
+		}
+		return songs.Put(be32(song.ID), data)
+	})
+}
+
+func (b *BoltStore) DeleteSong(songID uint32) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		songs := tx.Bucket(songsBucket)
+		if data := songs.Get(be32(songID)); data != nil {
+			var song types.Song
+			if err := json.Unmarshal(data, &song); err != nil {
+				return err
+			}
+			if err := tx.Bucket(songKeysBucket).Delete([]byte(utils.GenerateSongKey(song.Title, song.Artist))); err != nil {
+				return err
+			}
+			if err := songs.Delete(be32(songID)); err != nil {
+				return err
+			}
+			if err := addCounter(tx, songCountKey, -1); err != nil {
+				return err
+			}
+		}
+
+		// Collect first; deleting while iterating skips keys in bbolt.
+		prefix := be32(songID)
+		bySong := tx.Bucket(songFingerprintsBucket)
+		var keys [][]byte
+		c := bySong.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, bytes.Clone(k))
+		}
+
+		fingerprints := tx.Bucket(fingerprintsBucket)
+		for i, k := range keys {
+			address := binary.BigEndian.Uint32(k[4:])
+			// Keys are sorted by address, so each address starts a run.
+			if i == 0 || address != binary.BigEndian.Uint32(keys[i-1][4:]) {
+				if err := addFrequency(tx, address, -1); err != nil {
+					return err
+				}
+			}
+			anchor := binary.BigEndian.Uint32(k[8:])
+			if err := fingerprints.Delete(key3(address, songID, anchor)); err != nil {
+				return err
+			}
+			if err := bySong.Delete(k); err != nil {
+				return err
+			}
+		}
+		return addCounter(tx, fingerprintCountKey, -len(keys))
+	})
+}
+
+func (b *BoltStore) TotalSongs() (int, error) {
+	return b.counter(songCountKey)
+}
+
+func (b *BoltStore) StoreFingerprints(songID uint32, fingerprints []types.Hash) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		byAddress := tx.Bucket(fingerprintsBucket)
+		bySong := tx.Bucket(songFingerprintsBucket)
+
+		added := 0
+		for _, hash := range fingerprints {
+			k := key3(hash.Address, songID, hash.AnchorTimeMs)
+			if hasKey(byAddress, k) {
+				continue
+			}
+			songAddress := key3(songID, hash.Address, 0)[:8]
+			if prefix, _ := bySong.Cursor().Seek(songAddress); !bytes.HasPrefix(prefix, songAddress) {
+				if err := addFrequency(tx, hash.Address, 1); err != nil {
+					return err
+				}
+			}
+			if err := byAddress.Put(k, nil); err != nil {
+				return fmt.Errorf("error storing fingerprint: %s", err)
+			}
+			if err := bySong.Put(key3(songID, hash.Address, hash.AnchorTimeMs), nil); err != nil {
+				return fmt.Errorf("error storing fingerprint: %s", err)
+			}
+			added++
+		}
+		return addCounter(tx, fingerprintCountKey, added)
+	})
+}
+
+func (b *BoltStore) GetCouples(addresses []uint32) (map[uint32][]types.Couple, error) {
+	couples := make(map[uint32][]types.Couple)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(fingerprintsBucket).Cursor()
+		for _, address := range addresses {
+			prefix := be32(address)
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				couples[address] = append(couples[address], types.Couple{
+					SongID:       binary.BigEndian.Uint32(k[4:]),
+					AnchorTimeMs: binary.BigEndian.Uint32(k[8:]),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	return couples, nil
+}
+
+func (b *BoltStore) GetSongFingerprints(songID uint32) ([]types.Hash, error) {
+	var hashes []types.Hash
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := be32(songID)
+		c := tx.Bucket(songFingerprintsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			hashes = append(hashes, types.Hash{
+				Address:      binary.BigEndian.Uint32(k[4:]),
+				AnchorTimeMs: binary.BigEndian.Uint32(k[8:]),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	return hashes, nil
+}
+
+func (b *BoltStore) ScanFingerprints(fn func(address uint32, couple types.Couple) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(fingerprintsBucket).ForEach(func(k, _ []byte) error {
+			return fn(binary.BigEndian.Uint32(k[0:]), types.Couple{
+				SongID:       binary.BigEndian.Uint32(k[4:]),
+				AnchorTimeMs: binary.BigEndian.Uint32(k[8:]),
+			})
+		})
+	})
+}
+
+func (b *BoltStore) SongIDs() ([]uint32, error) {
+	var ids []uint32
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(songFingerprintsBucket).Cursor()
+		// Jump from one song's prefix to the next.
+		for k, _ := c.First(); k != nil; {
+			id := binary.BigEndian.Uint32(k)
+			ids = append(ids, id)
+			if id == ^uint32(0) {
+				break
+			}
+			k, _ = c.Seek(be32(id + 1))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %s", err)
+	}
+	return ids, nil
+}
+
+func (b *BoltStore) TotalFingerprints() (int, error) {
+	return b.counter(fingerprintCountKey)
+}
+
+func (b *BoltStore) DocumentFrequencies(addresses []uint32) (map[uint32]int, error) {
+	frequencies := make(map[uint32]int)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(addressFrequenciesBucket)
+		for _, address := range addresses {
+			if v := bucket.Get(be32(address)); v != nil {
+				frequencies[address] = int(binary.BigEndian.Uint32(v))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying address frequencies: %s", err)
+	}
+	return frequencies, nil
+}
+
+func (b *BoltStore) GetMetadata(key string) (string, bool, error) {
+	var value string
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metadataBucket).Get([]byte(key)); v != nil {
+			value, found = string(v), true
+		}
+		return nil
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("error querying metadata: %s", err)
+	}
+	return value, found, nil
+}
+
+func (b *BoltStore) SetMetadata(key, value string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metadataBucket).Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		return fmt.Errorf("error storing metadata: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package db
+
+import "errors"
+
+// openBolt fails on js, where bbolt cannot lock or map its file; only the
+// memory store is available there.
+func openBolt(path string) (FingerprintStore, error) {
+	return nil, errors.New("the bolt store is not available on js")
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"shazam/types"
+	"testing"
+)
+
+const (
+	benchmarkSongs         = 10000
+	benchmarkHashesPerSong = 300
+	benchmarkQueryHashes   = 1000
+)
+
+// syntheticCatalog fills a new SQLite store with benchmarkSongs songs of
+// random hashes and returns it with a query of addresses taken from it.
+func syntheticCatalog(b *testing.B) (*SQLiteClient, []uint32) {
+	b.Helper()
+	client, err := DBClient(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { client.Close() })
+
+	// Rows are inserted directly in one transaction; StoreFingerprints
+	// also maintains the address frequencies, which GetCouples ignores.
+	tx, err := client.db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	songStmt, err := tx.Prepare("INSERT INTO songs (id, title, artist, ytID, key) VALUES (?, ?, '', '', ?)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	hashStmt, err := tx.Prepare("INSERT OR IGNORE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	var query []uint32
+	for songID := 1; songID <= benchmarkSongs; songID++ {
+		title := fmt.Sprintf("Song %d", songID)
+		if _, err := songStmt.Exec(songID, title, title); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < benchmarkHashesPerSong; i++ {
+			address := rng.Uint32()
+			if _, err := hashStmt.Exec(address, uint32(i*50), songID); err != nil {
+				b.Fatal(err)
+			}
+			if rng.Intn(benchmarkSongs*benchmarkHashesPerSong/benchmarkQueryHashes) == 0 {
+				query = append(query, address)
+			}
+		}
+	}
+	songStmt.Close()
+	hashStmt.Close()
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+
+	return client, query
+}
+
+// getCouplesPerAddress is the lookup GetCouples replaced: one query for
+// every address.
+func getCouplesPerAddress(client *SQLiteClient, addresses []uint32) (map[uint32][]types.Couple, error) {
+	couples := make(map[uint32][]types.Couple)
+	for _, address := range addresses {
+		rows, err := client.db.Query("SELECT anchorTimeMs, songID FROM fingerprints WHERE address = ?", address)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var couple types.Couple
+			if err := rows.Scan(&couple.AnchorTimeMs, &couple.SongID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			couples[address] = append(couples[address], couple)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return couples, nil
+}
+
+func BenchmarkGetCouples(b *testing.B) {
+	client, query := syntheticCatalog(b)
+
+	perAddress, err := getCouplesPerAddress(client, query)
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunked, err := client.GetCouples(query)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !reflect.DeepEqual(perAddress, chunked) {
+		b.Fatalf("chunked lookup found postings for %d addresses, per-address lookup for %d", len(chunked), len(perAddress))
+	}
+
+	b.Run("per-address", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := getCouplesPerAddress(client, query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("chunked", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.GetCouples(query); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
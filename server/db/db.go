@@ -3,111 +3,439 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"runtime"
 	"shazam/types"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// couplesChunkSize is how many addresses GetCouples looks up per statement,
+// well below SQLite's limit on bound parameters.
+const couplesChunkSize = 500
+
+// sqliteOptions are added to the database path. WAL lets readers run next
+// to the single writer, the busy timeout makes contending writers wait for
+// each other instead of failing with "database is locked", and immediate
+// transactions take the write lock up front so it is never upgraded from a
+// read lock, which SQLite refuses without waiting.
+const sqliteOptions = "_journal_mode=WAL&_busy_timeout=10000&_txlock=immediate&_synchronous=NORMAL"
+
+// fingerprintCountMetadataKey is where the number of stored fingerprints is
+// kept in the metadata table, like the counters bucket of a BoltStore.
+const fingerprintCountMetadataKey = "fingerprint_count"
+
+// SQLiteClient is safe for concurrent use; open one per process and share
+// it.
 type SQLiteClient struct {
 	db *sql.DB
+
+	// Statements of the lookup paths, prepared when the client opens.
+	couplesStmt           *sql.Stmt
+	frequenciesStmt       *sql.Stmt
+	songByIDStmt          *sql.Stmt
+	songExistsStmt        *sql.Stmt
+	totalSongsStmt        *sql.Stmt
+	totalFingerprintsStmt *sql.Stmt
 }
 
 func (db *SQLiteClient) TotalSongs() (int, error) {
 	var count int
-	err := db.db.QueryRow("SELECT COUNT(*) FROM songs").Scan(&count)
+	err := db.totalSongsStmt.QueryRow().Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("error counting songs: %s", err)
 	}
 	return count, nil
 }
 
-func DBClient(path string) (*SQLiteClient, error) {
-	db, err := sql.Open("sqlite3", path)
+// TotalFingerprints returns the count kept up to date by StoreFingerprints
+// and DeleteSong, so matching does not scan the fingerprints table.
+func (db *SQLiteClient) TotalFingerprints() (int, error) {
+	var count int
+	err := db.totalFingerprintsStmt.QueryRow().Scan(&count)
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to SQLite: %s", err)
+		return 0, fmt.Errorf("error counting fingerprints: %s", err)
 	}
+	return count, nil
+}
 
-	err = createTables(db)
+// DBClient opens the SQLite database at path, migrating it to the current
+// schema first.
+func DBClient(path string) (*SQLiteClient, error) {
+	db, err := openSQLite(path)
 	if err != nil {
-		return nil, fmt.Errorf("error creating tables: %s", err)
+		return nil, err
 	}
 
-	return &SQLiteClient{db: db}, nil
-}
+	applied, backup, err := migrate(db, path)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+	// New databases are migrated from scratch; only upgrades are worth noting.
+	if len(applied) > 0 && backup != "" {
+		slog.Info("Migrated database schema", "path", path,
+			"version", applied[len(applied)-1].Version, "backup", backup)
+	}
 
-func (client *SQLiteClient) Close() error {
-	return client.db.Close()
+	client := &SQLiteClient{db: db}
+	if err := client.prepareStatements(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
 }
 
-// createTables creates the required tables if they don't exist
-func createTables(db *sql.DB) error {
-	createSongsTable := `
-    CREATE TABLE IF NOT EXISTS songs (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        title TEXT NOT NULL,
-        artist TEXT NOT NULL,
-        ytID TEXT,
-        key TEXT NOT NULL UNIQUE
-    );
-    `
-
-	createFingerprintsTable := `
-    CREATE TABLE IF NOT EXISTS fingerprints (
-        address INTEGER NOT NULL,
-        anchorTimeMs INTEGER NOT NULL,
-        songID INTEGER NOT NULL,
-        PRIMARY KEY (address, anchorTimeMs, songID)
-    );
-    `
-
-	_, err := db.Exec(createSongsTable)
+// openSQLite opens the database at path with sqliteOptions.
+func openSQLite(path string) (*sql.DB, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", path+separator+sqliteOptions)
 	if err != nil {
-		return fmt.Errorf("error creating songs table: %s", err)
+		return nil, fmt.Errorf("error connecting to SQLite: %s", err)
 	}
 
-	_, err = db.Exec(createFingerprintsTable)
-	if err != nil {
-		return fmt.Errorf("error creating fingerprints table: %s", err)
+	// Readers proceed in parallel under WAL; idle connections are kept so
+	// their prepared statements are reused.
+	db.SetMaxOpenConns(2 * runtime.NumCPU())
+	db.SetMaxIdleConns(2 * runtime.NumCPU())
+	db.SetConnMaxIdleTime(5 * time.Minute)
+	return db, nil
+}
+
+func (client *SQLiteClient) prepareStatements() error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", couplesChunkSize), ",")
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&client.couplesStmt, "SELECT address, anchorTimeMs, songID FROM fingerprints WHERE address IN (" + placeholders + ")"},
+		{&client.frequenciesStmt, "SELECT address, songs FROM addressFrequencies WHERE address IN (" + placeholders + ")"},
+		{&client.songByIDStmt, "SELECT " + songColumns + " FROM songs WHERE id = ?"},
+		{&client.songExistsStmt, "SELECT COUNT(*) FROM songs WHERE key = ?"},
+		{&client.totalSongsStmt, "SELECT COUNT(*) FROM songs"},
+		{&client.totalFingerprintsStmt, "SELECT COALESCE((SELECT CAST(value AS INTEGER) FROM metadata WHERE key = '" + fingerprintCountMetadataKey + "'), 0)"},
 	}
 
+	for _, s := range statements {
+		stmt, err := client.db.Prepare(s.query)
+		if err != nil {
+			return fmt.Errorf("error preparing statement: %s", err)
+		}
+		*s.stmt = stmt
+	}
 	return nil
 }
 
+func (client *SQLiteClient) Close() error {
+	for _, stmt := range []*sql.Stmt{client.couplesStmt, client.frequenciesStmt, client.songByIDStmt,
+		client.songExistsStmt, client.totalSongsStmt, client.totalFingerprintsStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return client.db.Close()
+}
+
+// GetCouples returns the postings of every address. Addresses are looked up
+// couplesChunkSize at a time with a single prepared statement; the last
+// chunk is padded by repeating an address so every chunk fits it.
 func (db *SQLiteClient) GetCouples(addresses []uint32) (map[uint32][]types.Couple, error) {
 	couples := make(map[uint32][]types.Couple)
+	if len(addresses) == 0 {
+		return couples, nil
+	}
+
+	args := make([]any, couplesChunkSize)
+	for start := 0; start < len(addresses); start += couplesChunkSize {
+		chunk := addresses[start:min(start+couplesChunkSize, len(addresses))]
+		for i := range args {
+			args[i] = chunk[min(i, len(chunk)-1)]
+		}
 
-	for _, address := range addresses {
-		rows, err := db.db.Query("SELECT anchorTimeMs, songID FROM fingerprints WHERE address = ?", address)
+		rows, err := db.couplesStmt.Query(args...)
 		if err != nil {
 			return nil, fmt.Errorf("error querying database: %s", err)
 		}
 
-		var docCouples []types.Couple
 		for rows.Next() {
+			var address uint32
 			var couple types.Couple
-			if err := rows.Scan(&couple.AnchorTimeMs, &couple.SongID); err != nil {
+			if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
 				rows.Close() // close before returning error
 				return nil, fmt.Errorf("error scanning row: %s", err)
 			}
-			docCouples = append(docCouples, couple)
+			couples[address] = append(couples[address], couple)
 		}
-
+		err = rows.Err()
 		rows.Close() // close explicitly after reading
-
-		couples[address] = docCouples
+		if err != nil {
+			return nil, fmt.Errorf("error reading rows: %s", err)
+		}
 	}
 
 	return couples, nil
 }
 
-func (db *SQLiteClient) GetSongByID(songID uint32) (types.Song, bool, error) {
+// DocumentFrequencies returns the number of songs each address occurs in.
+// Addresses that occur in no song are left out.
+func (db *SQLiteClient) DocumentFrequencies(addresses []uint32) (map[uint32]int, error) {
+	frequencies := make(map[uint32]int)
+	if len(addresses) == 0 {
+		return frequencies, nil
+	}
+
+	// Chunks are padded as in GetCouples.
+	args := make([]any, couplesChunkSize)
+	for start := 0; start < len(addresses); start += couplesChunkSize {
+		chunk := addresses[start:min(start+couplesChunkSize, len(addresses))]
+		for i := range args {
+			args[i] = chunk[min(i, len(chunk)-1)]
+		}
+
+		rows, err := db.frequenciesStmt.Query(args...)
+		if err != nil {
+			return nil, fmt.Errorf("error querying address frequencies: %s", err)
+		}
+		for rows.Next() {
+			var address uint32
+			var songs int
+			if err := rows.Scan(&address, &songs); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning row: %s", err)
+			}
+			frequencies[address] = songs
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading rows: %s", err)
+		}
+	}
+	return frequencies, nil
+}
+
+// songColumns are the columns of the songs table read by scanSong.
+const songColumns = "id, title, artist, ytID, album, durationMs, releaseYear, isrc, genre, source, ingestedAt"
+
+// scanSong reads a row of songColumns. The tags are left to loadTags.
+func scanSong(row interface{ Scan(dest ...any) error }) (types.Song, error) {
 	var song types.Song
-	err := db.db.QueryRow("SELECT id, title, artist, ytID FROM songs WHERE id = ?", songID).Scan(&song.ID, &song.Title, &song.Artist, &song.YouTubeID)
+	var ingestedAt string
+	err := row.Scan(&song.ID, &song.Title, &song.Artist, &song.YouTubeID, &song.Album, &song.DurationMs,
+		&song.ReleaseYear, &song.ISRC, &song.Genre, &song.Source, &ingestedAt)
+	if err == nil && ingestedAt != "" {
+		song.IngestedAt, _ = time.Parse(time.RFC3339, ingestedAt)
+	}
+	return song, err
+}
+
+// querySongs runs a query selecting songColumns and loads the tags of the
+// songs it returns.
+func (db *SQLiteClient) querySongs(query string, args ...any) ([]types.Song, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying songs: %s", err)
+	}
+	defer rows.Close()
+
+	var songs []types.Song
+	for rows.Next() {
+		song, err := scanSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		songs = append(songs, song)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %s", err)
+	}
+	return songs, db.loadTags(songs)
+}
+
+// loadTags fills in the tags of songs.
+func (db *SQLiteClient) loadTags(songs []types.Song) error {
+	index := make(map[uint32]int, len(songs))
+	for i, song := range songs {
+		index[song.ID] = i
+	}
+
+	for start := 0; start < len(songs); start += couplesChunkSize {
+		chunk := songs[start:min(start+couplesChunkSize, len(songs))]
+		args := make([]any, len(chunk))
+		for i, song := range chunk {
+			args[i] = song.ID
+		}
+
+		rows, err := db.db.Query("SELECT songID, key, value FROM songTags WHERE songID IN (?"+
+			strings.Repeat(", ?", len(chunk)-1)+")", args...)
+		if err != nil {
+			return fmt.Errorf("error querying song tags: %s", err)
+		}
+		for rows.Next() {
+			var songID uint32
+			var key, value string
+			if err := rows.Scan(&songID, &key, &value); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning row: %s", err)
+			}
+			song := &songs[index[songID]]
+			if song.Tags == nil {
+				song.Tags = map[string]string{}
+			}
+			song.Tags[key] = value
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("error reading rows: %s", err)
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteClient) GetSongByID(songID uint32) (types.Song, bool, error) {
+	song, err := scanSong(db.songByIDStmt.QueryRow(songID))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return song, false, nil
+			return types.Song{}, false, nil
 		}
 		return song, false, fmt.Errorf("error querying song by ID: %s", err)
 	}
-	return song, true, nil
+
+	songs := []types.Song{song}
+	if err := db.loadTags(songs); err != nil {
+		return song, false, err
+	}
+	return songs[0], true, nil
+}
+
+// ListSongs returns every registered song ordered by artist and title.
+func (db *SQLiteClient) ListSongs() ([]types.Song, error) {
+	return db.querySongs("SELECT " + songColumns + " FROM songs ORDER BY artist, title, id")
+}
+
+// FindSongs returns the page of songs selected by query and the number of
+// songs matching it on all pages.
+func (db *SQLiteClient) FindSongs(query SongQuery) ([]types.Song, int, error) {
+	where, args := "", []any{}
+	if query.Text != "" {
+		pattern := "%" + likeEscaper.Replace(query.Text) + "%"
+		where = ` WHERE title LIKE ? ESCAPE '\' OR artist LIKE ? ESCAPE '\'`
+		args = append(args, pattern, pattern)
+	}
+
+	var total int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM songs"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting songs: %s", err)
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	songs, err := db.querySongs("SELECT "+songColumns+" FROM songs"+where+" ORDER BY artist, title, id LIMIT ? OFFSET ?",
+		append(args, limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return songs, total, nil
+}
+
+// likeEscaper escapes the LIKE wildcards in user supplied text.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SongFingerprintCount returns the number of hashes stored for a song.
+func (db *SQLiteClient) SongFingerprintCount(songID uint32) (int, error) {
+	var count int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM fingerprints WHERE songID = ?", songID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting fingerprints: %s", err)
+	}
+	return count, nil
+}
+
+// SongIDs returns the ID of every song that has fingerprints stored.
+func (db *SQLiteClient) SongIDs() ([]uint32, error) {
+	rows, err := db.db.Query("SELECT DISTINCT songID FROM fingerprints")
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %s", err)
+	}
+	defer rows.Close()
+
+	var ids []uint32
+	for rows.Next() {
+		var id uint32
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetSongFingerprints returns every hash stored for a song.
+func (db *SQLiteClient) GetSongFingerprints(songID uint32) ([]types.Hash, error) {
+	rows, err := db.db.Query("SELECT address, anchorTimeMs FROM fingerprints WHERE songID = ?", songID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	defer rows.Close()
+
+	var hashes []types.Hash
+	for rows.Next() {
+		var hash types.Hash
+		if err := rows.Scan(&hash.Address, &hash.AnchorTimeMs); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// ScanFingerprints calls fn for every stored fingerprint in address order.
+func (db *SQLiteClient) ScanFingerprints(fn func(address uint32, couple types.Couple) error) error {
+	rows, err := db.db.Query("SELECT address, anchorTimeMs, songID FROM fingerprints ORDER BY address")
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var couple types.Couple
+		if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		if err := fn(address, couple); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetMetadata returns the value stored under key in the metadata table.
+func (db *SQLiteClient) GetMetadata(key string) (string, bool, error) {
+	var value string
+	err := db.db.QueryRow("SELECT value FROM metadata WHERE key = ?", key).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("error querying metadata: %s", err)
+	}
+	return value, true, nil
+}
+
+// SetMetadata stores value under key, replacing any previous value.
+func (db *SQLiteClient) SetMetadata(key, value string) error {
+	_, err := db.db.Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES (?, ?)", key, value)
+	if err != nil {
+		return fmt.Errorf("error storing metadata: %s", err)
+	}
+	return nil
 }
@@ -1,58 +1,245 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"shazam/types"
 	"shazam/utils"
-
-	"github.com/mattn/go-sqlite3"
+	"time"
 )
 
-func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
+// ErrSongExists is returned by RegisterSong when a song with the same key is
+// already in the database.
+var ErrSongExists = errors.New("song already exists")
+
+// ErrSongNotFound is returned when a song ID is not in the database.
+var ErrSongNotFound = errors.New("song not found")
+
+func (db *SQLiteClient) RegisterSong(song types.Song) (uint32, error) {
 	tx, err := db.db.Begin()
 	if err != nil {
 		return 0, fmt.Errorf("error starting transaction: %s", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO songs (id, title, artist, ytID, key) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare(`INSERT INTO songs (id, title, artist, ytID, key, album, durationMs, releaseYear, isrc, genre, source, ingestedAt)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		tx.Rollback()
 		return 0, fmt.Errorf("error preparing statement: %s", err)
 	}
 	defer stmt.Close()
 
-	songID := utils.GenerateUniqueID()
-	songKey := utils.GenerateSongKey(songTitle, songArtist)
-	if _, err := stmt.Exec(songID, songTitle, songArtist, ytID, songKey); err != nil {
+	// Pick a free ID first, so that a constraint error can only mean the key.
+	songID := song.ID
+	for {
+		if songID != 0 {
+			var taken int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM songs WHERE id = ?", songID).Scan(&taken); err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("error checking song ID: %s", err)
+			}
+			if taken == 0 {
+				break
+			}
+		}
+		songID = utils.GenerateUniqueID()
+	}
+
+	ingestedAt := song.IngestedAt
+	if ingestedAt.IsZero() {
+		ingestedAt = time.Now()
+	}
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	if _, err := stmt.Exec(songID, song.Title, song.Artist, song.YouTubeID, songKey, song.Album, song.DurationMs,
+		song.ReleaseYear, song.ISRC, song.Genre, song.Source, ingestedAt.UTC().Format(time.RFC3339)); err != nil {
 		tx.Rollback()
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
-			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
+		if isConstraintError(err) {
+			return 0, fmt.Errorf("%w: %v", ErrSongExists, err)
 		}
 		return 0, fmt.Errorf("failed to register song: %v", err)
 	}
+	if err := insertTags(tx, songID, song.Tags); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
 
 	return songID, tx.Commit()
 }
 
-func (db *SQLiteClient) StoreFingerprints(fingerprints map[uint32]types.Couple) error {
+// StoreFingerprints stores every hash of a song. Exact duplicates of a
+// stored (address, anchor time) pair are ignored. The document frequency of
+// every address new to the song is incremented.
+func (db *SQLiteClient) StoreFingerprints(songID uint32, fingerprints []types.Hash) error {
 	tx, err := db.db.Begin()
 	if err != nil {
 		return fmt.Errorf("error starting transaction: %s", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
+	// Count addresses before storing the hashes that make them known.
+	frequencyStmt, err := tx.Prepare(`INSERT INTO addressFrequencies (address, songs)
+        SELECT ?, 1 WHERE NOT EXISTS (SELECT 1 FROM fingerprints WHERE address = ? AND songID = ?)
+        ON CONFLICT (address) DO UPDATE SET songs = songs + 1`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error preparing statement: %s", err)
+	}
+	defer frequencyStmt.Close()
+
+	counted := make(map[uint32]struct{})
+	for _, hash := range fingerprints {
+		if _, ok := counted[hash.Address]; ok {
+			continue
+		}
+		counted[hash.Address] = struct{}{}
+		if _, err := frequencyStmt.Exec(hash.Address, hash.Address, songID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error updating address frequency: %s", err)
+		}
+	}
+
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("error preparing statement: %s", err)
 	}
 	defer stmt.Close()
 
-	for address, couple := range fingerprints {
-		if _, err := stmt.Exec(address, couple.AnchorTimeMs, couple.SongID); err != nil {
+	var stored int64
+	for _, hash := range fingerprints {
+		result, err := stmt.Exec(hash.Address, hash.AnchorTimeMs, songID)
+		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("error executing statement: %s", err)
 		}
+		n, _ := result.RowsAffected()
+		stored += n
+	}
+
+	if err := addFingerprintCount(tx, stored); err != nil {
+		tx.Rollback()
+		return err
 	}
 
 	return tx.Commit()
 }
+
+// addFingerprintCount adds delta to the fingerprint count in the metadata
+// table.
+func addFingerprintCount(tx *sql.Tx, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT INTO metadata (key, value) VALUES (?, ?)
+        ON CONFLICT (key) DO UPDATE SET value = CAST(value AS INTEGER) + excluded.value`,
+		fingerprintCountMetadataKey, delta)
+	if err != nil {
+		return fmt.Errorf("error updating fingerprint count: %s", err)
+	}
+	return nil
+}
+
+// SongExists reports whether a song with the given key is already registered.
+func (db *SQLiteClient) SongExists(songKey string) (bool, error) {
+	var count int
+	err := db.songExistsStmt.QueryRow(songKey).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking song key: %s", err)
+	}
+	return count > 0, nil
+}
+
+// DeleteSong removes a song and all of its fingerprints in one transaction.
+func (db *SQLiteClient) DeleteSong(songID uint32) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+
+	_, err = tx.Exec(`UPDATE addressFrequencies SET songs = songs - 1
+        WHERE address IN (SELECT DISTINCT address FROM fingerprints WHERE songID = ?)`, songID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error updating address frequencies: %s", err)
+	}
+	if _, err := tx.Exec("DELETE FROM addressFrequencies WHERE songs <= 0"); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error updating address frequencies: %s", err)
+	}
+	result, err := tx.Exec("DELETE FROM fingerprints WHERE songID = ?", songID)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error deleting fingerprints: %s", err)
+	}
+	deleted, _ := result.RowsAffected()
+	if err := addFingerprintCount(tx, -deleted); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM songTags WHERE songID = ?", songID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error deleting song tags: %s", err)
+	}
+	if _, err := tx.Exec("DELETE FROM songs WHERE id = ?", songID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error deleting song: %s", err)
+	}
+
+	return tx.Commit()
+}
+
+// UpdateSong replaces everything stored about the song with song.ID but its
+// ingest time. It fails with ErrSongExists if another song already has the
+// new title and artist.
+func (db *SQLiteClient) UpdateSong(song types.Song) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	result, err := tx.Exec(`UPDATE songs SET title = ?, artist = ?, ytID = ?, key = ?, album = ?, durationMs = ?,
+        releaseYear = ?, isrc = ?, genre = ?, source = ? WHERE id = ?`,
+		song.Title, song.Artist, song.YouTubeID, songKey, song.Album, song.DurationMs,
+		song.ReleaseYear, song.ISRC, song.Genre, song.Source, song.ID)
+	if err != nil {
+		tx.Rollback()
+		if isConstraintError(err) {
+			return fmt.Errorf("%w: %v", ErrSongExists, err)
+		}
+		return fmt.Errorf("error updating song: %s", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("%w: %d", ErrSongNotFound, song.ID)
+	}
+
+	if _, err := tx.Exec("DELETE FROM songTags WHERE songID = ?", song.ID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error deleting song tags: %s", err)
+	}
+	if err := insertTags(tx, song.ID, song.Tags); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertTags stores the tags of a song within tx.
+func insertTags(tx *sql.Tx, songID uint32, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare("INSERT INTO songTags (songID, key, value) VALUES (?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %s", err)
+	}
+	defer stmt.Close()
+
+	for key, value := range tags {
+		if _, err := stmt.Exec(songID, key, value); err != nil {
+			return fmt.Errorf("error storing song tag: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package db
+
+import (
+	"fmt"
+	"maps"
+	"shazam/types"
+	"shazam/utils"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	memoryStoresMu sync.Mutex
+	memoryStores   = map[string]*MemoryStore{}
+)
+
+// MemoryStore keeps the catalog in process memory. It is meant for tests
+// and throwaway servers; nothing is persisted.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	songs    map[uint32]types.Song
+	songKeys map[string]uint32
+
+	postings map[uint32][]types.Couple
+	bySong   map[uint32][]types.Hash
+	// stored holds every (address, anchor time, song) triple for
+	// duplicate detection.
+	stored map[[3]uint32]struct{}
+	// songAddresses counts the hashes of every (address, song) pair, and
+	// frequencies the songs of every address.
+	songAddresses map[[2]uint32]int
+	frequencies   map[uint32]int
+
+	metadata map[string]string
+}
+
+// MemoryClient returns the memory store called name, creating it on first
+// use, so every caller in the process shares the same catalog.
+func MemoryClient(name string) *MemoryStore {
+	memoryStoresMu.Lock()
+	defer memoryStoresMu.Unlock()
+
+	if store, ok := memoryStores[name]; ok {
+		return store
+	}
+	store := &MemoryStore{
+		songs:    map[uint32]types.Song{},
+		songKeys: map[string]uint32{},
+		postings: map[uint32][]types.Couple{},
+		bySong:   map[uint32][]types.Hash{},
+		stored:   map[[3]uint32]struct{}{},
+		metadata: map[string]string{},
+
+		songAddresses: map[[2]uint32]int{},
+		frequencies:   map[uint32]int{},
+	}
+	memoryStores[name] = store
+	return store
+}
+
+// Close does nothing; the catalog lives as long as the process.
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) RegisterSong(song types.Song) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	if _, ok := m.songKeys[songKey]; ok {
+		return 0, fmt.Errorf("%w: %s", ErrSongExists, songKey)
+	}
+
+	songID := song.ID
+	for _, ok := m.songs[songID]; ok || songID == 0; _, ok = m.songs[songID] {
+		songID = utils.GenerateUniqueID()
+	}
+	song.ID = songID
+	if song.IngestedAt.IsZero() {
+		song.IngestedAt = time.Now().UTC()
+	}
+	m.songs[songID] = cloneSong(song)
+	m.songKeys[songKey] = songID
+	return songID, nil
+}
+
+func (m *MemoryStore) SongExists(songKey string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.songKeys[songKey]
+	return ok, nil
+}
+
+func (m *MemoryStore) GetSongByID(songID uint32) (types.Song, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	song, ok := m.songs[songID]
+	return cloneSong(song), ok, nil
+}
+
+func (m *MemoryStore) ListSongs() ([]types.Song, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	songs := make([]types.Song, 0, len(m.songs))
+	for _, song := range m.songs {
+		songs = append(songs, cloneSong(song))
+	}
+	slices.SortFunc(songs, compareSongs)
+	return songs, nil
+}
+
+func (m *MemoryStore) FindSongs(query SongQuery) ([]types.Song, int, error) {
+	songs, err := m.ListSongs()
+	if err != nil {
+		return nil, 0, err
+	}
+	songs, total := filterSongs(songs, query)
+	return songs, total, nil
+}
+
+func (m *MemoryStore) SongFingerprintCount(songID uint32) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.bySong[songID]), nil
+}
+
+func (m *MemoryStore) UpdateSong(song types.Song) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.songs[song.ID]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrSongNotFound, song.ID)
+	}
+	oldKey := utils.GenerateSongKey(old.Title, old.Artist)
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	if id, ok := m.songKeys[songKey]; ok && id != song.ID {
+		return fmt.Errorf("%w: %s", ErrSongExists, songKey)
+	}
+
+	delete(m.songKeys, oldKey)
+	m.songKeys[songKey] = song.ID
+	song.IngestedAt = old.IngestedAt
+	m.songs[song.ID] = cloneSong(song)
+	return nil
+}
+
+// cloneSong copies the tags of song, which would otherwise be shared between
+// the store and its callers.
+func cloneSong(song types.Song) types.Song {
+	song.Tags = maps.Clone(song.Tags)
+	return song
+}
+
+func (m *MemoryStore) DeleteSong(songID uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if song, ok := m.songs[songID]; ok {
+		delete(m.songKeys, utils.GenerateSongKey(song.Title, song.Artist))
+		delete(m.songs, songID)
+	}
+
+	for _, hash := range m.bySong[songID] {
+		delete(m.stored, [3]uint32{hash.Address, hash.AnchorTimeMs, songID})
+		pair := [2]uint32{hash.Address, songID}
+		if _, ok := m.songAddresses[pair]; ok {
+			delete(m.songAddresses, pair)
+			m.frequencies[hash.Address]--
+			if m.frequencies[hash.Address] <= 0 {
+				delete(m.frequencies, hash.Address)
+			}
+		}
+		couples := slices.DeleteFunc(m.postings[hash.Address], func(c types.Couple) bool {
+			return c.SongID == songID
+		})
+		if len(couples) == 0 {
+			delete(m.postings, hash.Address)
+		} else {
+			m.postings[hash.Address] = couples
+		}
+	}
+	delete(m.bySong, songID)
+	return nil
+}
+
+func (m *MemoryStore) TotalSongs() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.songs), nil
+}
+
+func (m *MemoryStore) StoreFingerprints(songID uint32, fingerprints []types.Hash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, hash := range fingerprints {
+		key := [3]uint32{hash.Address, hash.AnchorTimeMs, songID}
+		if _, ok := m.stored[key]; ok {
+			continue
+		}
+		m.stored[key] = struct{}{}
+		pair := [2]uint32{hash.Address, songID}
+		if m.songAddresses[pair] == 0 {
+			m.frequencies[hash.Address]++
+		}
+		m.songAddresses[pair]++
+		m.postings[hash.Address] = append(m.postings[hash.Address], types.Couple{
+			AnchorTimeMs: hash.AnchorTimeMs,
+			SongID:       songID,
+		})
+		m.bySong[songID] = append(m.bySong[songID], hash)
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetCouples(addresses []uint32) (map[uint32][]types.Couple, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	couples := make(map[uint32][]types.Couple)
+	for _, address := range addresses {
+		if found, ok := m.postings[address]; ok {
+			couples[address] = slices.Clone(found)
+		}
+	}
+	return couples, nil
+}
+
+func (m *MemoryStore) GetSongFingerprints(songID uint32) ([]types.Hash, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.bySong[songID]), nil
+}
+
+func (m *MemoryStore) ScanFingerprints(fn func(address uint32, couple types.Couple) error) error {
+	m.mu.RLock()
+	addresses := make([]uint32, 0, len(m.postings))
+	for address := range m.postings {
+		addresses = append(addresses, address)
+	}
+	m.mu.RUnlock()
+	slices.Sort(addresses)
+
+	for _, address := range addresses {
+		m.mu.RLock()
+		couples := slices.Clone(m.postings[address])
+		m.mu.RUnlock()
+
+		for _, couple := range couples {
+			if err := fn(address, couple); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SongIDs() ([]uint32, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]uint32, 0, len(m.bySong))
+	for id := range m.bySong {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m *MemoryStore) TotalFingerprints() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.stored), nil
+}
+
+func (m *MemoryStore) DocumentFrequencies(addresses []uint32) (map[uint32]int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	frequencies := make(map[uint32]int)
+	for _, address := range addresses {
+		if n, ok := m.frequencies[address]; ok {
+			frequencies[address] = n
+		}
+	}
+	return frequencies, nil
+}
+
+func (m *MemoryStore) GetMetadata(key string) (string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.metadata[key]
+	return value, ok, nil
+}
+
+func (m *MemoryStore) SetMetadata(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metadata[key] = value
+	return nil
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when a database was migrated by a newer build
+// than this one.
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+// migration is one step of the SQLite schema. Migrations are applied in
+// order, each in its own transaction, and never edited once released: a
+// schema change is a new migration appended to the list.
+type migration struct {
+	version     int
+	description string
+	// sql, if set, is executed first; up, if set, runs after it.
+	sql string
+	up  func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create songs, fingerprints and metadata tables",
+		// IF NOT EXISTS adopts databases created before migrations existed.
+		sql: `
+    CREATE TABLE IF NOT EXISTS songs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        title TEXT NOT NULL,
+        artist TEXT NOT NULL,
+        ytID TEXT,
+        key TEXT NOT NULL UNIQUE
+    );
+
+    CREATE TABLE IF NOT EXISTS fingerprints (
+        address INTEGER NOT NULL,
+        anchorTimeMs INTEGER NOT NULL,
+        songID INTEGER NOT NULL,
+        PRIMARY KEY (address, anchorTimeMs, songID)
+    );
+
+    CREATE INDEX IF NOT EXISTS fingerprints_songID ON fingerprints (songID);
+
+    CREATE TABLE IF NOT EXISTS metadata (
+        key TEXT PRIMARY KEY,
+        value TEXT NOT NULL
+    );
+    `,
+	},
+	{
+		version:     2,
+		description: "count the songs every address occurs in",
+		sql: `
+    CREATE TABLE IF NOT EXISTS addressFrequencies (
+        address INTEGER PRIMARY KEY,
+        songs INTEGER NOT NULL
+    );
+    `,
+		up: func(tx *sql.Tx) error {
+			// The table may already be filled by a build that kept it up
+			// to date before it was a migration.
+			var counted bool
+			if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM addressFrequencies)").Scan(&counted); err != nil || counted {
+				return err
+			}
+			_, err := tx.Exec(`
+    INSERT INTO addressFrequencies (address, songs)
+    SELECT address, COUNT(DISTINCT songID) FROM fingerprints GROUP BY address
+    `)
+			return err
+		},
+	},
+	{
+		version:     3,
+		description: "add song metadata columns and the songTags table",
+		sql: `
+    ALTER TABLE songs ADD COLUMN album TEXT NOT NULL DEFAULT '';
+    ALTER TABLE songs ADD COLUMN durationMs INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE songs ADD COLUMN releaseYear INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE songs ADD COLUMN isrc TEXT NOT NULL DEFAULT '';
+    ALTER TABLE songs ADD COLUMN genre TEXT NOT NULL DEFAULT '';
+    ALTER TABLE songs ADD COLUMN source TEXT NOT NULL DEFAULT '';
+    ALTER TABLE songs ADD COLUMN ingestedAt TEXT NOT NULL DEFAULT '';
+
+    CREATE TABLE songTags (
+        songID INTEGER NOT NULL,
+        key TEXT NOT NULL,
+        value TEXT NOT NULL,
+        PRIMARY KEY (songID, key)
+    );
+    `,
+	},
+	{
+		version:     4,
+		description: "keep the fingerprint count in the metadata table",
+		sql: `
+    INSERT OR REPLACE INTO metadata (key, value)
+    SELECT 'fingerprint_count', COUNT(*) FROM fingerprints;
+    `,
+	},
+}
+
+// MigrationStatus describes one migration of a database.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	// AppliedAt is when the migration was applied, zero while pending.
+	AppliedAt time.Time
+}
+
+// SchemaStatus returns every migration known to this build, and whether it
+// is applied to the SQLite database at path. It does not change the
+// database beyond creating the schema_version table.
+func SchemaStatus(path string) ([]MigrationStatus, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status = append(status, MigrationStatus{Version: m.version, Description: m.description, AppliedAt: applied[m.version]})
+	}
+	return status, nil
+}
+
+// Migrate brings the SQLite database at path up to date. Existing databases
+// are backed up next to path first. It returns the migrations it applied
+// and the backup path, which is empty if no backup was needed.
+func Migrate(path string) ([]MigrationStatus, string, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	return migrate(db, path)
+}
+
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        description TEXT NOT NULL,
+        appliedAt TEXT NOT NULL
+    );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("error creating schema_version table: %s", err)
+	}
+
+	rows, err := db.Query("SELECT version, appliedAt FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("error querying schema version: %s", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		applied[version], _ = time.Parse(time.RFC3339, appliedAt)
+	}
+	return applied, rows.Err()
+}
+
+func migrate(db *sql.DB, path string) ([]MigrationStatus, string, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, "", err
+	}
+
+	current := 0
+	for version := range applied {
+		current = max(current, version)
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return nil, "", fmt.Errorf("%w: version %d, this build knows up to %d", ErrSchemaTooNew, current, latest)
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, "", nil
+	}
+
+	backup, err := backupDatabase(db, path, current)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var done []MigrationStatus
+	for _, m := range pending {
+		ok, err := applyMigration(db, m)
+		if err != nil {
+			return done, backup, fmt.Errorf("error applying migration %d (%s): %w", m.version, m.description, err)
+		}
+		if ok {
+			done = append(done, MigrationStatus{Version: m.version, Description: m.description, AppliedAt: time.Now()})
+		}
+	}
+	return done, backup, nil
+}
+
+// applyMigration runs m in a transaction. It reports false if another
+// connection applied m first.
+func applyMigration(db *sql.DB, m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	// Claim the version first: the write locks the database before any
+	// read, and the insert is ignored if m was applied in the meantime.
+	result, err := tx.Exec("INSERT OR IGNORE INTO schema_version (version, description, appliedAt) VALUES (?, ?, ?)",
+		m.version, m.description, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		return false, err
+	}
+
+	if m.sql != "" {
+		if _, err := tx.Exec(m.sql); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	if m.up != nil {
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// backupDatabase copies a database that holds any tables besides
+// schema_version to path.v<version>.<time>.bak and returns the copy's path.
+// New and in-memory databases are not backed up.
+func backupDatabase(db *sql.DB, path string, version int) (string, error) {
+	if path == "" || path == ":memory:" || strings.HasPrefix(path, "file:") {
+		return "", nil
+	}
+
+	var tables int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_version'").Scan(&tables)
+	if err != nil {
+		return "", fmt.Errorf("error inspecting database: %s", err)
+	}
+	if tables == 0 {
+		return "", nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.%s.bak", path, version, time.Now().Format("20060102-150405"))
+	if _, err := db.Exec("VACUUM INTO ?", backup); err != nil {
+		return "", fmt.Errorf("error backing up database to %s: %s", backup, err)
+	}
+	return backup, nil
+}
@@ -0,0 +1,11 @@
+//go:build cgo
+
+package db
+
+import "github.com/mattn/go-sqlite3"
+
+// isConstraintError reports whether err is a violated SQLite constraint.
+func isConstraintError(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.Code == sqlite3.ErrConstraint
+}
@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package db
+
+// isConstraintError is always false without cgo, where the SQLite driver
+// is a stub that cannot open a database.
+func isConstraintError(err error) bool {
+	return false
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"cmp"
+	"fmt"
+	"shazam/types"
+	"slices"
+	"strings"
+)
+
+// Store backends accepted by Open.
+const (
+	StoreSQLite = "sqlite"
+	StoreBolt   = "bolt"
+	StoreMemory = "memory"
+)
+
+// FingerprintStore is a catalog of songs and their fingerprints.
+type FingerprintStore interface {
+	// RegisterSong adds a song and returns its ID: song.ID if that is set
+	// and free, a new ID otherwise. A zero IngestedAt is set to the current
+	// time. It fails with ErrSongExists if a song with the same title and
+	// artist exists.
+	RegisterSong(song types.Song) (uint32, error)
+	SongExists(songKey string) (bool, error)
+	GetSongByID(songID uint32) (types.Song, bool, error)
+	// ListSongs returns every registered song ordered by artist and title.
+	ListSongs() ([]types.Song, error)
+	// FindSongs returns the page of songs selected by query, ordered as
+	// ListSongs, and the number of songs matching query on all pages.
+	FindSongs(query SongQuery) ([]types.Song, int, error)
+	// SongFingerprintCount returns the number of hashes stored for a song.
+	SongFingerprintCount(songID uint32) (int, error)
+	// UpdateSong replaces everything stored about the song with song.ID but
+	// its ingest time. It fails with ErrSongNotFound if there is no such
+	// song and with ErrSongExists if another song has the new title and
+	// artist.
+	UpdateSong(song types.Song) error
+	// DeleteSong removes a song and all of its fingerprints.
+	DeleteSong(songID uint32) error
+	TotalSongs() (int, error)
+
+	// StoreFingerprints stores every hash of a song, ignoring exact
+	// duplicates of stored (address, anchor time) pairs.
+	StoreFingerprints(songID uint32, fingerprints []types.Hash) error
+	// GetCouples returns the postings of every address that has any.
+	GetCouples(addresses []uint32) (map[uint32][]types.Couple, error)
+	GetSongFingerprints(songID uint32) ([]types.Hash, error)
+	// ScanFingerprints calls fn for every fingerprint in address order.
+	ScanFingerprints(fn func(address uint32, couple types.Couple) error) error
+	// SongIDs returns the ID of every song that has fingerprints stored.
+	SongIDs() ([]uint32, error)
+	TotalFingerprints() (int, error)
+	// DocumentFrequencies returns the number of songs each address occurs
+	// in. Addresses that occur in no song are left out.
+	DocumentFrequencies(addresses []uint32) (map[uint32]int, error)
+
+	GetMetadata(key string) (string, bool, error)
+	SetMetadata(key, value string) error
+
+	Close() error
+}
+
+var (
+	_ FingerprintStore = (*SQLiteClient)(nil)
+	_ FingerprintStore = (*MemoryStore)(nil)
+)
+
+// Open opens the store of the given backend at path. Memory stores are
+// shared by path within the process.
+func Open(backend, path string) (FingerprintStore, error) {
+	switch backend {
+	case StoreSQLite, "":
+		return DBClient(path)
+	case StoreBolt:
+		return openBolt(path)
+	case StoreMemory:
+		return MemoryClient(path), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
+
+// SongQuery selects a page of songs.
+type SongQuery struct {
+	// Text, if set, keeps the songs whose title or artist contains it,
+	// ignoring case.
+	Text string
+	// Limit is the page size, or 0 for no limit; Offset is the number of
+	// matching songs skipped.
+	Limit  int
+	Offset int
+}
+
+// filterSongs applies query to songs sorted as ListSongs returns them.
+func filterSongs(songs []types.Song, query SongQuery) ([]types.Song, int) {
+	if query.Text != "" {
+		text := strings.ToLower(query.Text)
+		songs = slices.DeleteFunc(songs, func(song types.Song) bool {
+			return !strings.Contains(strings.ToLower(song.Title), text) &&
+				!strings.Contains(strings.ToLower(song.Artist), text)
+		})
+	}
+
+	total := len(songs)
+	songs = songs[min(query.Offset, total):]
+	if query.Limit > 0 && len(songs) > query.Limit {
+		songs = songs[:query.Limit]
+	}
+	return songs, total
+}
+
+// compareSongs orders songs as ListSongs returns them.
+func compareSongs(a, b types.Song) int {
+	return cmp.Or(cmp.Compare(a.Artist, b.Artist), cmp.Compare(a.Title, b.Title), cmp.Compare(a.ID, b.ID))
+}
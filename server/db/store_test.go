@@ -0,0 +1,367 @@
+package db
+
+import (
+	"cmp"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"shazam/types"
+	"shazam/utils"
+	"slices"
+	"testing"
+	"time"
+)
+
+// storeBackends opens an empty store of every backend.
+var storeBackends = []struct {
+	name string
+	open func(t *testing.T) FingerprintStore
+}{
+	{StoreSQLite, func(t *testing.T) FingerprintStore {
+		store, err := DBClient(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{StoreBolt, func(t *testing.T) FingerprintStore {
+		store, err := BoltClient(filepath.Join(t.TempDir(), "test.bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{StoreMemory, func(t *testing.T) FingerprintStore {
+		// Memory stores are shared by name, so every test gets its own.
+		return MemoryClient(t.Name())
+	}},
+}
+
+// storeTests is the behaviour every FingerprintStore must share.
+var storeTests = []struct {
+	name string
+	run  func(t *testing.T, store FingerprintStore)
+}{
+	{"register", testRegisterSong},
+	{"duplicate key", testDuplicateKey},
+	{"update", testUpdateSong},
+	{"store", testStoreFingerprints},
+	{"couples", testGetCouples},
+	{"delete", testDeleteSong},
+	{"counters", testCounters},
+	{"metadata", testMetadata},
+}
+
+func TestFingerprintStore(t *testing.T) {
+	for _, backend := range storeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range storeTests {
+				t.Run(test.name, func(t *testing.T) {
+					store := backend.open(t)
+					defer store.Close()
+					test.run(t, store)
+				})
+			}
+		})
+	}
+}
+
+func mustRegister(t *testing.T, store FingerprintStore, song types.Song) uint32 {
+	t.Helper()
+	id, err := store.RegisterSong(song)
+	if err != nil {
+		t.Fatalf("RegisterSong(%q) failed: %v", song.Title, err)
+	}
+	return id
+}
+
+func mustStore(t *testing.T, store FingerprintStore, songID uint32, hashes []types.Hash) {
+	t.Helper()
+	if err := store.StoreFingerprints(songID, hashes); err != nil {
+		t.Fatalf("StoreFingerprints(%d) failed: %v", songID, err)
+	}
+}
+
+func mustGetSong(t *testing.T, store FingerprintStore, songID uint32) types.Song {
+	t.Helper()
+	song, ok, err := store.GetSongByID(songID)
+	if err != nil || !ok {
+		t.Fatalf("GetSongByID(%d) = %v, %v", songID, ok, err)
+	}
+	return song
+}
+
+// assertCount fails unless count returns want.
+func assertCount(t *testing.T, name string, count func() (int, error), want int) {
+	t.Helper()
+	got, err := count()
+	if err != nil {
+		t.Fatalf("%s failed: %v", name, err)
+	}
+	if got != want {
+		t.Fatalf("%s = %d, want %d", name, got, want)
+	}
+}
+
+func sortedHashes(hashes []types.Hash) []types.Hash {
+	return slices.SortedFunc(slices.Values(hashes), func(a, b types.Hash) int {
+		return cmp.Or(cmp.Compare(a.Address, b.Address), cmp.Compare(a.AnchorTimeMs, b.AnchorTimeMs))
+	})
+}
+
+func sortedCouples(couples []types.Couple) []types.Couple {
+	return slices.SortedFunc(slices.Values(couples), func(a, b types.Couple) int {
+		return cmp.Or(cmp.Compare(a.SongID, b.SongID), cmp.Compare(a.AnchorTimeMs, b.AnchorTimeMs))
+	})
+}
+
+func testRegisterSong(t *testing.T, store FingerprintStore) {
+	ingested := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	song := types.Song{
+		Title:     "Song One",
+		Artist:    "Artist A",
+		YouTubeID: "yt1",
+		SongMetadata: types.SongMetadata{
+			Album:       "Album",
+			DurationMs:  180000,
+			ReleaseYear: 1999,
+			ISRC:        "USRC17607839",
+			Genre:       "Rock",
+			Source:      "/music/one.flac",
+			IngestedAt:  ingested,
+			Tags:        map[string]string{"label": "Label"},
+		},
+	}
+	id := mustRegister(t, store, song)
+
+	got := mustGetSong(t, store, id)
+	song.ID = id
+	if !reflect.DeepEqual(got, song) {
+		t.Fatalf("GetSongByID = %+v, want %+v", got, song)
+	}
+
+	exists, err := store.SongExists(utils.GenerateSongKey("Song One", "Artist A"))
+	if err != nil || !exists {
+		t.Fatalf("SongExists = %v, %v, want true", exists, err)
+	}
+	if _, ok, err := store.GetSongByID(id + 1); err != nil || ok {
+		t.Fatalf("GetSongByID of an unknown ID = %v, %v, want not found", ok, err)
+	}
+
+	// A requested ID is used while it is free, and replaced once taken.
+	requested := mustRegister(t, store, types.Song{ID: 4242, Title: "Song Two", Artist: "Artist B"})
+	if requested != 4242 {
+		t.Fatalf("RegisterSong with free ID 4242 returned %d", requested)
+	}
+	taken := mustRegister(t, store, types.Song{ID: 4242, Title: "Song Three", Artist: "Artist B"})
+	if taken == 4242 || taken == id {
+		t.Fatalf("RegisterSong with taken ID 4242 returned %d", taken)
+	}
+
+	// A zero ingest time is set on registration.
+	if mustGetSong(t, store, taken).IngestedAt.IsZero() {
+		t.Fatal("RegisterSong left IngestedAt zero")
+	}
+}
+
+func testDuplicateKey(t *testing.T, store FingerprintStore) {
+	mustRegister(t, store, types.Song{Title: "Song One", Artist: "Artist A"})
+
+	_, err := store.RegisterSong(types.Song{Title: "Song One", Artist: "Artist A", YouTubeID: "other"})
+	if !errors.Is(err, ErrSongExists) {
+		t.Fatalf("registering a duplicate key returned %v, want ErrSongExists", err)
+	}
+	assertCount(t, "TotalSongs", store.TotalSongs, 1)
+}
+
+func testUpdateSong(t *testing.T, store FingerprintStore) {
+	one := mustRegister(t, store, types.Song{Title: "Song One", Artist: "Artist A"})
+	two := mustRegister(t, store, types.Song{Title: "Song Two", Artist: "Artist A",
+		SongMetadata: types.SongMetadata{Tags: map[string]string{"mood": "calm"}}})
+	ingested := mustGetSong(t, store, two).IngestedAt
+
+	update := types.Song{ID: two, Title: "Song Two (Live)", Artist: "Artist A",
+		SongMetadata: types.SongMetadata{Genre: "Live", Tags: map[string]string{"venue": "Hall"}}}
+	if err := store.UpdateSong(update); err != nil {
+		t.Fatalf("UpdateSong failed: %v", err)
+	}
+	got := mustGetSong(t, store, two)
+	update.IngestedAt = ingested
+	if !reflect.DeepEqual(got, update) {
+		t.Fatalf("updated song = %+v, want %+v", got, update)
+	}
+	if exists, _ := store.SongExists(utils.GenerateSongKey("Song Two", "Artist A")); exists {
+		t.Fatal("the old key still exists after UpdateSong")
+	}
+
+	err := store.UpdateSong(types.Song{ID: two, Title: "Song One", Artist: "Artist A"})
+	if !errors.Is(err, ErrSongExists) {
+		t.Fatalf("updating to the key of song %d returned %v, want ErrSongExists", one, err)
+	}
+	err = store.UpdateSong(types.Song{ID: two + one + 100, Title: "Song Four", Artist: "Artist A"})
+	if !errors.Is(err, ErrSongNotFound) {
+		t.Fatalf("updating an unknown song returned %v, want ErrSongNotFound", err)
+	}
+}
+
+func testStoreFingerprints(t *testing.T, store FingerprintStore) {
+	id := mustRegister(t, store, types.Song{Title: "Song One", Artist: "Artist A"})
+	hashes := []types.Hash{{Address: 10, AnchorTimeMs: 0}, {Address: 10, AnchorTimeMs: 500}, {Address: 20, AnchorTimeMs: 500}}
+	mustStore(t, store, id, hashes)
+	// Exact duplicates are ignored, new pairs are added.
+	mustStore(t, store, id, []types.Hash{{Address: 10, AnchorTimeMs: 0}, {Address: 30, AnchorTimeMs: 1000}})
+
+	want := sortedHashes(append(hashes, types.Hash{Address: 30, AnchorTimeMs: 1000}))
+	got, err := store.GetSongFingerprints(id)
+	if err != nil {
+		t.Fatalf("GetSongFingerprints failed: %v", err)
+	}
+	if got := sortedHashes(got); !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetSongFingerprints = %v, want %v", got, want)
+	}
+	assertCount(t, "SongFingerprintCount", func() (int, error) { return store.SongFingerprintCount(id) }, len(want))
+
+	var scanned []uint32
+	err = store.ScanFingerprints(func(address uint32, couple types.Couple) error {
+		if couple.SongID != id {
+			t.Errorf("ScanFingerprints reported song %d, want %d", couple.SongID, id)
+		}
+		scanned = append(scanned, address)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanFingerprints failed: %v", err)
+	}
+	if !slices.IsSorted(scanned) || len(scanned) != len(want) {
+		t.Fatalf("ScanFingerprints visited addresses %v, want %d in order", scanned, len(want))
+	}
+}
+
+func testGetCouples(t *testing.T, store FingerprintStore) {
+	one := mustRegister(t, store, types.Song{Title: "Song One", Artist: "Artist A"})
+	two := mustRegister(t, store, types.Song{Title: "Song Two", Artist: "Artist B"})
+	mustStore(t, store, one, []types.Hash{{Address: 10, AnchorTimeMs: 100}, {Address: 10, AnchorTimeMs: 200}, {Address: 20, AnchorTimeMs: 300}})
+	mustStore(t, store, two, []types.Hash{{Address: 10, AnchorTimeMs: 400}})
+
+	couples, err := store.GetCouples([]uint32{10, 20, 99})
+	if err != nil {
+		t.Fatalf("GetCouples failed: %v", err)
+	}
+	want := map[uint32][]types.Couple{
+		10: {{AnchorTimeMs: 100, SongID: one}, {AnchorTimeMs: 200, SongID: one}, {AnchorTimeMs: 400, SongID: two}},
+		20: {{AnchorTimeMs: 300, SongID: one}},
+	}
+	if len(couples) != len(want) {
+		t.Fatalf("GetCouples returned addresses %v, want 10 and 20", couples)
+	}
+	for address, postings := range want {
+		if got := sortedCouples(couples[address]); !reflect.DeepEqual(got, sortedCouples(postings)) {
+			t.Fatalf("postings of %d = %v, want %v", address, got, postings)
+		}
+	}
+
+	frequencies, err := store.DocumentFrequencies([]uint32{10, 20, 99})
+	if err != nil {
+		t.Fatalf("DocumentFrequencies failed: %v", err)
+	}
+	if want := map[uint32]int{10: 2, 20: 1}; !reflect.DeepEqual(frequencies, want) {
+		t.Fatalf("DocumentFrequencies = %v, want %v", frequencies, want)
+	}
+
+	// Lookups larger than one SQLite chunk return every posting.
+	many := make([]types.Hash, 2*couplesChunkSize+1)
+	addresses := make([]uint32, len(many))
+	for i := range many {
+		many[i] = types.Hash{Address: uint32(1000 + i), AnchorTimeMs: uint32(i)}
+		addresses[i] = many[i].Address
+	}
+	mustStore(t, store, two, many)
+	couples, err = store.GetCouples(addresses)
+	if err != nil {
+		t.Fatalf("GetCouples failed: %v", err)
+	}
+	if len(couples) != len(addresses) {
+		t.Fatalf("GetCouples of %d addresses returned %d", len(addresses), len(couples))
+	}
+}
+
+func testDeleteSong(t *testing.T, store FingerprintStore) {
+	one := mustRegister(t, store, types.Song{Title: "Song One", Artist: "Artist A",
+		SongMetadata: types.SongMetadata{Tags: map[string]string{"mood": "calm"}}})
+	two := mustRegister(t, store, types.Song{Title: "Song Two", Artist: "Artist B"})
+	mustStore(t, store, one, []types.Hash{{Address: 10, AnchorTimeMs: 100}, {Address: 20, AnchorTimeMs: 200}})
+	mustStore(t, store, two, []types.Hash{{Address: 10, AnchorTimeMs: 300}})
+
+	if err := store.DeleteSong(one); err != nil {
+		t.Fatalf("DeleteSong failed: %v", err)
+	}
+
+	if _, ok, err := store.GetSongByID(one); err != nil || ok {
+		t.Fatalf("GetSongByID of a deleted song = %v, %v", ok, err)
+	}
+	if exists, _ := store.SongExists(utils.GenerateSongKey("Song One", "Artist A")); exists {
+		t.Fatal("the key of a deleted song still exists")
+	}
+	couples, err := store.GetCouples([]uint32{10, 20})
+	if err != nil {
+		t.Fatalf("GetCouples failed: %v", err)
+	}
+	if want := map[uint32][]types.Couple{10: {{AnchorTimeMs: 300, SongID: two}}}; !reflect.DeepEqual(couples, want) {
+		t.Fatalf("GetCouples after delete = %v, want %v", couples, want)
+	}
+	frequencies, err := store.DocumentFrequencies([]uint32{10, 20})
+	if err != nil {
+		t.Fatalf("DocumentFrequencies failed: %v", err)
+	}
+	if want := map[uint32]int{10: 1}; !reflect.DeepEqual(frequencies, want) {
+		t.Fatalf("DocumentFrequencies after delete = %v, want %v", frequencies, want)
+	}
+
+	// The key is free again.
+	again := mustRegister(t, store, types.Song{Title: "Song One", Artist: "Artist A"})
+	if tags := mustGetSong(t, store, again).Tags; len(tags) != 0 {
+		t.Fatalf("a song registered again inherited the tags %v", tags)
+	}
+}
+
+func testCounters(t *testing.T, store FingerprintStore) {
+	assertCount(t, "TotalSongs", store.TotalSongs, 0)
+	assertCount(t, "TotalFingerprints", store.TotalFingerprints, 0)
+
+	one := mustRegister(t, store, types.Song{Title: "Song One", Artist: "Artist A"})
+	two := mustRegister(t, store, types.Song{Title: "Song Two", Artist: "Artist B"})
+	mustStore(t, store, one, []types.Hash{{Address: 10, AnchorTimeMs: 100}, {Address: 20, AnchorTimeMs: 200}})
+	mustStore(t, store, one, []types.Hash{{Address: 10, AnchorTimeMs: 100}})
+	mustStore(t, store, two, []types.Hash{{Address: 10, AnchorTimeMs: 100}})
+	assertCount(t, "TotalSongs", store.TotalSongs, 2)
+	assertCount(t, "TotalFingerprints", store.TotalFingerprints, 3)
+
+	ids, err := store.SongIDs()
+	if err != nil {
+		t.Fatalf("SongIDs failed: %v", err)
+	}
+	if slices.Sort(ids); !reflect.DeepEqual(ids, slices.Sorted(slices.Values([]uint32{one, two}))) {
+		t.Fatalf("SongIDs = %v, want %d and %d", ids, one, two)
+	}
+
+	if err := store.DeleteSong(one); err != nil {
+		t.Fatalf("DeleteSong failed: %v", err)
+	}
+	assertCount(t, "TotalSongs", store.TotalSongs, 1)
+	assertCount(t, "TotalFingerprints", store.TotalFingerprints, 1)
+}
+
+func testMetadata(t *testing.T, store FingerprintStore) {
+	if _, ok, err := store.GetMetadata("missing"); err != nil || ok {
+		t.Fatalf("GetMetadata of a missing key = %v, %v", ok, err)
+	}
+	for _, value := range []string{"first", "second"} {
+		if err := store.SetMetadata("key", value); err != nil {
+			t.Fatalf("SetMetadata failed: %v", err)
+		}
+		got, ok, err := store.GetMetadata("key")
+		if err != nil || !ok || got != value {
+			t.Fatalf("GetMetadata = %q, %v, %v, want %q", got, ok, err, value)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"shazam/db"
+	waveid "shazam/process"
+	"shazam/types"
+)
+
+// findDuplicates prints every group of duplicate songs in the catalog. With
+// remove set, all but the first song of each group are deleted; with merge
+// set, the first song also takes over metadata it lacks from the deleted
+// songs.
+func findDuplicates(dbClient db.FingerprintStore, opts waveid.DuplicateOptions, remove, merge bool) {
+	groups, err := waveid.FindDuplicates(dbClient, fpConfig, opts)
+	if err != nil {
+		fmt.Println("Error finding duplicates:", err)
+		return
+	}
+	if len(groups) == 0 {
+		fmt.Println("No duplicates found.")
+		return
+	}
+
+	for i, group := range groups {
+		titles := map[uint32]string{}
+		fmt.Printf("\nGroup %d:\n", i+1)
+		for j, song := range group.Songs {
+			titles[song.ID] = song.Title
+			marker := "keep"
+			if j > 0 {
+				marker = "dupe"
+			}
+			fmt.Printf("  %s  %s by %s (id %d)\n", marker, song.Title, song.Artist, song.ID)
+		}
+		for _, pair := range group.Pairs {
+			fmt.Printf("        %.0f%% of %q found in %q at %s and %.0f%% the other way, confidence: %.2f\n",
+				pair.Overlap*100, titles[pair.SongID], titles[pair.OtherID],
+				formatPosition(uint32(max(pair.OffsetMs, 0))), pair.ReverseOverlap*100, pair.Confidence)
+		}
+	}
+
+	if !remove && !merge {
+		fmt.Println("\nRun with -delete or -merge to remove the duplicates.")
+		return
+	}
+
+	removed := 0
+	for _, group := range groups {
+		// Delete first, so metadata merged into the kept song, such as the
+		// artist, cannot collide with the key of a song still stored.
+		deleted := []types.Song{group.Songs[0]}
+		for _, song := range group.Songs[1:] {
+			if err := dbClient.DeleteSong(song.ID); err != nil {
+				fmt.Printf("Error deleting %s (id %d): %v\n", song.Title, song.ID, err)
+				continue
+			}
+			deleted = append(deleted, song)
+			removed++
+		}
+		if merge {
+			if err := mergeSongs(dbClient, deleted); err != nil {
+				fmt.Printf("Error merging into %s: %v\n", group.Songs[0].Title, err)
+			}
+		}
+	}
+	fmt.Printf("\nRemoved %d duplicate songs.\n", removed)
+}
+
+// mergeSongs fills in the metadata songs[0] lacks from the other songs,
+// which must already be deleted.
+func mergeSongs(dbClient db.FingerprintStore, songs []types.Song) error {
+	keep := songs[0]
+	changed := false
+	fill := func(dst *string, src string) {
+		if *dst == "" && src != "" {
+			*dst, changed = src, true
+		}
+	}
+	for _, song := range songs[1:] {
+		fill(&keep.YouTubeID, song.YouTubeID)
+		fill(&keep.Artist, song.Artist)
+		fill(&keep.Album, song.Album)
+		fill(&keep.ISRC, song.ISRC)
+		fill(&keep.Genre, song.Genre)
+		fill(&keep.Source, song.Source)
+		if keep.ReleaseYear == 0 && song.ReleaseYear != 0 {
+			keep.ReleaseYear, changed = song.ReleaseYear, true
+		}
+		for key, value := range song.Tags {
+			if _, ok := keep.Tags[key]; !ok {
+				if keep.Tags == nil {
+					keep.Tags = map[string]string{}
+				}
+				keep.Tags[key], changed = value, true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return dbClient.UpdateSong(keep)
+}
@@ -0,0 +1,294 @@
+// Package index keeps the fingerprints table in memory as an inverted index
+// from address to postings, so lookups do not touch the database.
+package index
+
+import (
+	"shazam/types"
+	"slices"
+	"sync"
+)
+
+// Source is the database an Index is loaded from and kept in sync with.
+type Source interface {
+	ScanFingerprints(fn func(address uint32, couple types.Couple) error) error
+	SongIDs() ([]uint32, error)
+	GetSongFingerprints(songID uint32) ([]types.Hash, error)
+}
+
+// Index maps addresses to postings. Postings loaded at startup are kept in
+// compressed sparse row form: addresses is sorted and the postings of
+// addresses[i] are postings[offsets[i]:offsets[i+1]]. Songs added later go
+// to a small delta map that is merged in once it grows.
+// An Index is safe for concurrent use.
+type Index struct {
+	mu sync.RWMutex
+
+	addresses []uint32
+	offsets   []uint32
+	postings  []types.Couple
+	// buckets[h] is the first position in addresses whose top 16 bits are
+	// at least h, narrowing each binary search to a few cache lines.
+	buckets []uint32
+
+	delta      map[uint32][]types.Couple
+	deltaCount int
+
+	// songs holds every song with postings in the index.
+	songs map[uint32]struct{}
+
+	// release unmaps a snapshot backing the arrays above, if any.
+	release func() error
+}
+
+func newIndex() *Index {
+	return &Index{
+		offsets: []uint32{0},
+		buckets: make([]uint32, 1<<16+1),
+		delta:   map[uint32][]types.Couple{},
+		songs:   map[uint32]struct{}{},
+	}
+}
+
+// Load builds an index from every fingerprint in src.
+func Load(src Source) (*Index, error) {
+	ix := newIndex()
+	err := src.ScanFingerprints(func(address uint32, couple types.Couple) error {
+		if n := len(ix.addresses); n == 0 || ix.addresses[n-1] != address {
+			ix.addresses = append(ix.addresses, address)
+			ix.offsets = append(ix.offsets, ix.offsets[n])
+		}
+		ix.postings = append(ix.postings, couple)
+		ix.offsets[len(ix.offsets)-1]++
+		ix.songs[couple.SongID] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ix.buckets = bucketOffsets(ix.addresses)
+	return ix, nil
+}
+
+func bucketOffsets(addresses []uint32) []uint32 {
+	buckets := make([]uint32, 1<<16+1)
+	pos := 0
+	for h := range buckets {
+		for pos < len(addresses) && int(addresses[pos]>>16) < h {
+			pos++
+		}
+		buckets[h] = uint32(pos)
+	}
+	return buckets
+}
+
+// GetCouples returns the postings of every address, like the database
+// lookup it stands in for.
+func (ix *Index) GetCouples(addresses []uint32) (map[uint32][]types.Couple, error) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	couples := make(map[uint32][]types.Couple, len(addresses))
+	for _, address := range addresses {
+		var found []types.Couple
+		lo, hi := ix.buckets[address>>16], ix.buckets[address>>16+1]
+		if i, ok := slices.BinarySearch(ix.addresses[lo:hi], address); ok {
+			i += int(lo)
+			// Copy, the arrays may be a mapped snapshot.
+			found = append(found, ix.postings[ix.offsets[i]:ix.offsets[i+1]]...)
+		}
+		found = append(found, ix.delta[address]...)
+		if len(found) > 0 {
+			couples[address] = found
+		}
+	}
+	return couples, nil
+}
+
+// TotalFingerprints returns the number of postings in the index.
+func (ix *Index) TotalFingerprints() (int, error) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.postings) + ix.deltaCount, nil
+}
+
+// DocumentFrequencies returns the number of songs each address occurs in,
+// like the database lookup it stands in for. Addresses that occur in no
+// song are left out.
+func (ix *Index) DocumentFrequencies(addresses []uint32) (map[uint32]int, error) {
+	couples, err := ix.GetCouples(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	frequencies := make(map[uint32]int, len(couples))
+	songs := map[uint32]struct{}{}
+	for address, list := range couples {
+		clear(songs)
+		for _, couple := range list {
+			songs[couple.SongID] = struct{}{}
+		}
+		frequencies[address] = len(songs)
+	}
+	return frequencies, nil
+}
+
+// TotalSongs returns the number of songs in the index.
+func (ix *Index) TotalSongs() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.songs)
+}
+
+// Add indexes the fingerprints of a song. Adding a song that is already
+// indexed does nothing.
+func (ix *Index) Add(songID uint32, hashes []types.Hash) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if _, ok := ix.songs[songID]; ok {
+		return
+	}
+	ix.songs[songID] = struct{}{}
+	for _, hash := range hashes {
+		ix.delta[hash.Address] = append(ix.delta[hash.Address], types.Couple{
+			AnchorTimeMs: hash.AnchorTimeMs,
+			SongID:       songID,
+		})
+	}
+	ix.deltaCount += len(hashes)
+
+	// Merge once the delta is a sizeable fraction of the index, keeping
+	// lookups on the sorted arrays.
+	if ix.deltaCount > len(ix.postings)/8 {
+		ix.compact(nil)
+	}
+}
+
+// Remove drops the postings of the given songs.
+func (ix *Index) Remove(songIDs ...uint32) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	removed := map[uint32]struct{}{}
+	for _, id := range songIDs {
+		if _, ok := ix.songs[id]; ok {
+			removed[id] = struct{}{}
+			delete(ix.songs, id)
+		}
+	}
+	if len(removed) > 0 {
+		ix.compact(removed)
+	}
+}
+
+// Sync adds the songs src has and the index lacks, and removes the songs
+// the index has and src no longer does. It lets a running server pick up
+// songs ingested by another process.
+func (ix *Index) Sync(src Source) (added, removed int, err error) {
+	ids, err := src.SongIDs()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	current := make(map[uint32]struct{}, len(ids))
+	for _, id := range ids {
+		current[id] = struct{}{}
+	}
+
+	ix.mu.RLock()
+	var missing, stale []uint32
+	for id := range current {
+		if _, ok := ix.songs[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	for id := range ix.songs {
+		if _, ok := current[id]; !ok {
+			stale = append(stale, id)
+		}
+	}
+	ix.mu.RUnlock()
+
+	for _, id := range missing {
+		hashes, err := src.GetSongFingerprints(id)
+		if err != nil {
+			return added, 0, err
+		}
+		ix.Add(id, hashes)
+		added++
+	}
+	if len(stale) > 0 {
+		ix.Remove(stale...)
+	}
+	return added, len(stale), nil
+}
+
+// Close releases the snapshot backing the index, if any. The index must not
+// be used afterwards.
+func (ix *Index) Close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.releaseSnapshot()
+}
+
+func (ix *Index) releaseSnapshot() error {
+	if ix.release == nil {
+		return nil
+	}
+	err := ix.release()
+	ix.release = nil
+	return err
+}
+
+// compact merges the delta into the sorted arrays, dropping the postings of
+// removed songs. The caller holds the write lock.
+func (ix *Index) compact(removed map[uint32]struct{}) {
+	deltaAddresses := make([]uint32, 0, len(ix.delta))
+	for address := range ix.delta {
+		deltaAddresses = append(deltaAddresses, address)
+	}
+	slices.Sort(deltaAddresses)
+
+	addresses := make([]uint32, 0, len(ix.addresses)+len(deltaAddresses))
+	offsets := make([]uint32, 1, len(ix.addresses)+len(deltaAddresses)+1)
+	postings := make([]types.Couple, 0, len(ix.postings)+ix.deltaCount)
+
+	emit := func(address uint32, couples ...[]types.Couple) {
+		start := len(postings)
+		for _, list := range couples {
+			for _, couple := range list {
+				if _, ok := removed[couple.SongID]; !ok {
+					postings = append(postings, couple)
+				}
+			}
+		}
+		if len(postings) > start {
+			addresses = append(addresses, address)
+			offsets = append(offsets, uint32(len(postings)))
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(ix.addresses) || j < len(deltaAddresses) {
+		switch {
+		case j == len(deltaAddresses) || (i < len(ix.addresses) && ix.addresses[i] < deltaAddresses[j]):
+			emit(ix.addresses[i], ix.postings[ix.offsets[i]:ix.offsets[i+1]])
+			i++
+		case i == len(ix.addresses) || deltaAddresses[j] < ix.addresses[i]:
+			emit(deltaAddresses[j], ix.delta[deltaAddresses[j]])
+			j++
+		default:
+			emit(ix.addresses[i], ix.postings[ix.offsets[i]:ix.offsets[i+1]], ix.delta[deltaAddresses[j]])
+			i++
+			j++
+		}
+	}
+
+	// The old arrays may live in a mapped snapshot; they are no longer
+	// referenced once replaced.
+	ix.releaseSnapshot()
+	ix.addresses, ix.offsets, ix.postings = addresses, offsets, postings
+	ix.buckets = bucketOffsets(addresses)
+	ix.delta = map[uint32][]types.Couple{}
+	ix.deltaCount = 0
+}
@@ -0,0 +1,247 @@
+package index
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"shazam/db"
+	"shazam/types"
+	"slices"
+	"testing"
+)
+
+// songHashes returns n hashes for a song. Every song has a hash at each
+// shared address, spread over all buckets, and as many at addresses of its
+// own.
+func songHashes(songID uint32, n int) []types.Hash {
+	hashes := make([]types.Hash, 0, 2*n)
+	for i := range uint32(n) {
+		hashes = append(hashes,
+			types.Hash{Address: i * 2654435761, AnchorTimeMs: i*10 + songID},
+			types.Hash{Address: songID<<24 | i, AnchorTimeMs: i * 10})
+	}
+	return hashes
+}
+
+// testStore returns a memory store holding a song of n hashes for every
+// entry of songs, keyed by song ID.
+func testStore(t *testing.T, songs map[uint32]int) *db.MemoryStore {
+	store := db.MemoryClient(t.Name())
+	t.Cleanup(func() { store.Close() })
+	for songID, n := range songs {
+		addSong(t, store, songID, n)
+	}
+	return store
+}
+
+func addSong(t *testing.T, store *db.MemoryStore, songID uint32, n int) {
+	t.Helper()
+	id, err := store.RegisterSong(types.Song{ID: songID, Title: fmt.Sprintf("Song %d", songID), Artist: "Artist"})
+	if err != nil || id != songID {
+		t.Fatalf("RegisterSong(%d) = %d, %v", songID, id, err)
+	}
+	if err := store.StoreFingerprints(songID, songHashes(songID, n)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// query returns every address the songs up to maxSongID can have, and a
+// few that no song has.
+func query(maxSongID uint32, n int) []uint32 {
+	var addresses []uint32
+	for songID := range maxSongID + 1 {
+		for _, hash := range songHashes(songID, n) {
+			addresses = append(addresses, hash.Address)
+		}
+	}
+	return append(addresses, 0xFFFFFFFF, 0x00FFFFFF)
+}
+
+// checkMatchesStore fails unless ix serves the same postings, counts and
+// document frequencies as store.
+func checkMatchesStore(t *testing.T, ix *Index, store *db.MemoryStore, addresses []uint32) {
+	t.Helper()
+
+	want, err := store.GetCouples(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ix.GetCouples(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sortedCouples(got), sortedCouples(want)) {
+		t.Fatalf("GetCouples found postings for %d addresses, store for %d", len(got), len(want))
+	}
+
+	wantFrequencies, err := store.DocumentFrequencies(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotFrequencies, err := ix.DocumentFrequencies(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotFrequencies, wantFrequencies) {
+		t.Fatalf("DocumentFrequencies = %v, want %v", gotFrequencies, wantFrequencies)
+	}
+
+	wantTotal, _ := store.TotalFingerprints()
+	if total, _ := ix.TotalFingerprints(); total != wantTotal {
+		t.Fatalf("TotalFingerprints = %d, want %d", total, wantTotal)
+	}
+	wantSongs, _ := store.TotalSongs()
+	if songs := ix.TotalSongs(); songs != wantSongs {
+		t.Fatalf("TotalSongs = %d, want %d", songs, wantSongs)
+	}
+}
+
+// sortedCouples orders every posting list, which neither source promises.
+func sortedCouples(couples map[uint32][]types.Couple) map[uint32][]types.Couple {
+	for _, list := range couples {
+		slices.SortFunc(list, func(a, b types.Couple) int {
+			return cmp.Or(cmp.Compare(a.SongID, b.SongID), cmp.Compare(a.AnchorTimeMs, b.AnchorTimeMs))
+		})
+	}
+	return couples
+}
+
+func TestGetCouples(t *testing.T) {
+	store := testStore(t, map[uint32]int{1: 100, 2: 100, 3: 50})
+	ix, err := Load(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	checkMatchesStore(t, ix, store, query(3, 100))
+}
+
+func TestSync(t *testing.T) {
+	store := testStore(t, map[uint32]int{1: 100, 2: 100})
+	ix, err := Load(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	addSong(t, store, 3, 10)
+	if err := store.DeleteSong(1); err != nil {
+		t.Fatal(err)
+	}
+	added, removed, err := ix.Sync(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || removed != 1 {
+		t.Fatalf("Sync added %d and removed %d songs, want 1 and 1", added, removed)
+	}
+	checkMatchesStore(t, ix, store, query(3, 100))
+
+	// A second Sync finds nothing to do.
+	if added, removed, err := ix.Sync(store); added != 0 || removed != 0 || err != nil {
+		t.Fatalf("second Sync = %d, %d, %v, want 0, 0, nil", added, removed, err)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	// Song 1 has 800 postings, so the delta is merged once it holds more
+	// than 100.
+	store := testStore(t, map[uint32]int{1: 400})
+	ix, err := Load(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	addSong(t, store, 2, 40)
+	if _, _, err := ix.Sync(store); err != nil {
+		t.Fatal(err)
+	}
+	if ix.deltaCount != 80 || len(ix.postings) != 800 {
+		t.Fatalf("after a small song: %d postings in the delta and %d in the arrays, want 80 and 800",
+			ix.deltaCount, len(ix.postings))
+	}
+	checkMatchesStore(t, ix, store, query(3, 400))
+
+	addSong(t, store, 3, 20)
+	if _, _, err := ix.Sync(store); err != nil {
+		t.Fatal(err)
+	}
+	if ix.deltaCount != 0 || len(ix.postings) != 920 || len(ix.delta) != 0 {
+		t.Fatalf("after merging: %d postings in the delta and %d in the arrays, want 0 and 920",
+			ix.deltaCount, len(ix.postings))
+	}
+	if err := ix.validate(); err != nil {
+		t.Fatal(err)
+	}
+	checkMatchesStore(t, ix, store, query(3, 400))
+
+	// Removing a song merges as well and drops its postings.
+	if err := store.DeleteSong(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ix.Sync(store); err != nil {
+		t.Fatal(err)
+	}
+	checkMatchesStore(t, ix, store, query(3, 400))
+}
+
+func TestSnapshot(t *testing.T) {
+	store := testStore(t, map[uint32]int{1: 100, 2: 100})
+	ix, err := Load(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	// Leave a song in the delta; WriteSnapshot must merge it first.
+	addSong(t, store, 3, 5)
+	if _, _, err := ix.Sync(store); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "index.snapshot")
+	if err := ix.WriteSnapshot(path, "config-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		snapshot, err := OpenSnapshot(path, "config-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snapshot.Close()
+		checkMatchesStore(t, snapshot, store, query(4, 100))
+
+		// Songs added to a mapped snapshot are merged into new arrays.
+		addSong(t, store, 4, 100)
+		if _, _, err := snapshot.Sync(store); err != nil {
+			t.Fatal(err)
+		}
+		checkMatchesStore(t, snapshot, store, query(4, 100))
+	})
+
+	t.Run("tag mismatch", func(t *testing.T) {
+		_, err := OpenSnapshot(path, "config-b")
+		if !errors.Is(err, ErrSnapshotMismatch) {
+			t.Fatalf("err = %v, want ErrSnapshotMismatch", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		truncated := filepath.Join(t.TempDir(), "truncated.snapshot")
+		if err := os.WriteFile(truncated, data[:len(data)-4], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenSnapshot(truncated, "config-a"); err == nil {
+			t.Fatal("opened a truncated snapshot")
+		}
+	})
+}
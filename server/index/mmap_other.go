@@ -0,0 +1,12 @@
+//go:build !unix
+
+package index
+
+import "os"
+
+// mapFile reads path into memory on platforms without mmap support; there
+// is nothing to release.
+func mapFile(path string) (data []byte, release func() error, err error) {
+	data, err = os.ReadFile(path)
+	return data, nil, err
+}
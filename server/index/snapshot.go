@@ -0,0 +1,202 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"shazam/types"
+	"unsafe"
+)
+
+// A snapshot is the sorted arrays of an index written out as little-endian
+// uint32 values, so it can be mapped into memory and used in place:
+//
+//	magic   [8]byte  "WAVEIDX1"
+//	tag     [16]byte caller-defined, e.g. the fingerprint config ID
+//	counts  3 x uint64: addresses, postings, songs
+//	addresses [addresses]uint32
+//	offsets   [addresses+1]uint32
+//	postings  [postings]{anchorTimeMs, songID uint32}
+//	songs     [songs]uint32
+const (
+	snapshotMagic      = "WAVEIDX1"
+	snapshotTagSize    = 16
+	snapshotHeaderSize = len(snapshotMagic) + snapshotTagSize + 3*8
+)
+
+// ErrSnapshotMismatch is returned when a snapshot was written with a
+// different tag than the one expected.
+var ErrSnapshotMismatch = errors.New("index snapshot tag does not match")
+
+// WriteSnapshot writes the index to path. tag, at most 16 bytes, is stored
+// in the header and checked by OpenSnapshot. The file is written next to
+// path and renamed into place.
+func (ix *Index) WriteSnapshot(path, tag string) error {
+	if len(tag) > snapshotTagSize {
+		return fmt.Errorf("snapshot tag %q is longer than %d bytes", tag, snapshotTagSize)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.deltaCount > 0 {
+		ix.compact(nil)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %v", err)
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	copy(header[len(snapshotMagic):], tag)
+	counts := header[len(snapshotMagic)+snapshotTagSize:]
+	binary.LittleEndian.PutUint64(counts[0:], uint64(len(ix.addresses)))
+	binary.LittleEndian.PutUint64(counts[8:], uint64(len(ix.postings)))
+	binary.LittleEndian.PutUint64(counts[16:], uint64(len(ix.songs)))
+	w.Write(header)
+
+	var buf [4]byte
+	put := func(v uint32) {
+		binary.LittleEndian.PutUint32(buf[:], v)
+		w.Write(buf[:])
+	}
+	for _, v := range ix.addresses {
+		put(v)
+	}
+	for _, v := range ix.offsets {
+		put(v)
+	}
+	for _, couple := range ix.postings {
+		put(couple.AnchorTimeMs)
+		put(couple.SongID)
+	}
+	for id := range ix.songs {
+		put(id)
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing snapshot: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing snapshot: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// OpenSnapshot loads an index written by WriteSnapshot. It fails with
+// ErrSnapshotMismatch unless the snapshot was written with tag. Where the
+// platform allows, the file is mapped rather than read.
+func OpenSnapshot(path, tag string) (*Index, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening snapshot: %w", err)
+	}
+
+	inPlace := release != nil && nativeLittleEndian()
+	ix, err := decodeSnapshot(data, tag, inPlace)
+	if err != nil {
+		if release != nil {
+			release()
+		}
+		return nil, err
+	}
+	if inPlace {
+		ix.release = release
+	} else if release != nil {
+		release()
+	}
+	return ix, nil
+}
+
+// decodeSnapshot validates data and builds an index from it. With inPlace
+// the arrays point into data; otherwise they are copied out.
+func decodeSnapshot(data []byte, tag string, inPlace bool) (*Index, error) {
+	if len(data) < snapshotHeaderSize || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errors.New("not an index snapshot")
+	}
+
+	storedTag := data[len(snapshotMagic) : len(snapshotMagic)+snapshotTagSize]
+	var wantTag [snapshotTagSize]byte
+	copy(wantTag[:], tag)
+	if string(storedTag) != string(wantTag[:]) {
+		return nil, fmt.Errorf("%w: snapshot has %q, want %q", ErrSnapshotMismatch, trimTag(storedTag), tag)
+	}
+
+	counts := data[len(snapshotMagic)+snapshotTagSize:]
+	nAddresses := binary.LittleEndian.Uint64(counts[0:])
+	nPostings := binary.LittleEndian.Uint64(counts[8:])
+	nSongs := binary.LittleEndian.Uint64(counts[16:])
+	words := nAddresses + (nAddresses + 1) + 2*nPostings + nSongs
+	if uint64(len(data)-snapshotHeaderSize) != 4*words {
+		return nil, errors.New("index snapshot is truncated or corrupt")
+	}
+
+	body := data[snapshotHeaderSize:]
+	var u32 []uint32
+	if inPlace {
+		u32 = unsafe.Slice((*uint32)(unsafe.Pointer(unsafe.SliceData(body))), words)
+	} else {
+		u32 = make([]uint32, words)
+		for i := range u32 {
+			u32[i] = binary.LittleEndian.Uint32(body[4*i:])
+		}
+	}
+
+	ix := newIndex()
+	ix.addresses = u32[:nAddresses]
+	u32 = u32[nAddresses:]
+	ix.offsets = u32[:nAddresses+1]
+	u32 = u32[nAddresses+1:]
+	pairs := u32[:2*nPostings]
+	if len(pairs) > 0 {
+		ix.postings = unsafe.Slice((*types.Couple)(unsafe.Pointer(unsafe.SliceData(pairs))), nPostings)
+	}
+	for _, id := range u32[2*nPostings:] {
+		ix.songs[id] = struct{}{}
+	}
+
+	if err := ix.validate(); err != nil {
+		return nil, err
+	}
+	ix.buckets = bucketOffsets(ix.addresses)
+	return ix, nil
+}
+
+// validate checks the invariants lookups rely on.
+func (ix *Index) validate() error {
+	if ix.offsets[0] != 0 || int(ix.offsets[len(ix.offsets)-1]) != len(ix.postings) {
+		return errors.New("index snapshot offsets are corrupt")
+	}
+	for i := 1; i < len(ix.offsets); i++ {
+		if ix.offsets[i] < ix.offsets[i-1] {
+			return errors.New("index snapshot offsets are corrupt")
+		}
+	}
+	for i := 1; i < len(ix.addresses); i++ {
+		if ix.addresses[i] <= ix.addresses[i-1] {
+			return errors.New("index snapshot addresses are not sorted")
+		}
+	}
+	return nil
+}
+
+func trimTag(tag []byte) string {
+	for i, b := range tag {
+		if b == 0 {
+			return string(tag[:i])
+		}
+	}
+	return string(tag)
+}
+
+func nativeLittleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"shazam/db"
+	waveid "shazam/process"
+	"shazam/types"
+	"shazam/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+// audioExtensions lists the file types picked up by the index command.
+var audioExtensions = map[string]bool{
+	".mp3":  true,
+	".flac": true,
+	".wav":  true,
+	".m4a":  true,
+	".aac":  true,
+	".ogg":  true,
+	".opus": true,
+}
+
+// trackNumberPrefix matches leading track numbers such as "01 - " or "3. ".
+var trackNumberPrefix = regexp.MustCompile(`^\d+\s*[-_.)]?\s*`)
+
+type indexFailure struct {
+	path string
+	err  error
+}
+
+// indexDirectory walks dir and fingerprints every audio file that is not
+// already in the database, using at most MAX_WORKERS concurrent workers.
+func indexDirectory(dbClient db.FingerprintStore, dir string) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && audioExtensions[strings.ToLower(filepath.Ext(path))] {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Error walking directory:", err)
+		return
+	}
+
+	if len(files) == 0 {
+		fmt.Println("No audio files found in", dir)
+		return
+	}
+
+	if err := checkConfig(dbClient); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Printf("Indexing %d files from %s\n", len(files), dir)
+	startTime := time.Now()
+
+	sem := make(chan struct{}, MAX_WORKERS)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var indexed, skipped int
+	var failures []indexFailure
+
+	for _, file := range files {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			wasSkipped, err := indexFile(dbClient, path)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				failures = append(failures, indexFailure{path, err})
+			case wasSkipped:
+				skipped++
+			default:
+				indexed++
+				fmt.Printf("\t[ok] %s\n", path)
+			}
+		}(file)
+	}
+
+	wg.Wait()
+
+	fmt.Printf("\nIndexed: %d, skipped (already indexed): %d, failed: %d\n", indexed, skipped, len(failures))
+	if len(failures) > 0 {
+		fmt.Println("Failures:")
+		for _, f := range failures {
+			fmt.Printf("\t- %s: %v\n", f.path, f.err)
+		}
+	}
+	fmt.Printf("\nIndexing took: %s\n", time.Since(startTime))
+}
+
+// indexFile registers and fingerprints a single file.
+func indexFile(dbClient db.FingerprintStore, path string) (skipped bool, err error) {
+	song := readSongMetadata(path)
+
+	exists, err := dbClient.SongExists(utils.GenerateSongKey(song.Title, song.Artist))
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return true, nil
+	}
+
+	fingerprint, durationMs, err := waveid.FingerprintFile(path, fpConfig)
+	if err != nil {
+		return false, err
+	}
+	song.DurationMs = durationMs
+
+	songID, err := dbClient.RegisterSong(song)
+	if err != nil {
+		if errors.Is(err, db.ErrSongExists) {
+			return true, nil
+		}
+		return false, err
+	}
+	if err := dbClient.StoreFingerprints(songID, fingerprint); err != nil {
+		if delErr := dbClient.DeleteSong(songID); delErr != nil {
+			return false, fmt.Errorf("%v (cleanup failed: %v)", err, delErr)
+		}
+		return false, err
+	}
+
+	return false, nil
+}
+
+// readSongMetadata returns the song described by the file's tags, with the
+// title and artist falling back to an "Artist - Title" style file name.
+func readSongMetadata(path string) types.Song {
+	song := types.Song{SongMetadata: types.SongMetadata{Source: path}}
+	if abs, err := filepath.Abs(path); err == nil {
+		song.Source = abs
+	}
+
+	var title, artist string
+	if f, err := os.Open(path); err == nil {
+		m, err := tag.ReadFrom(f)
+		f.Close()
+		if err == nil {
+			title = strings.TrimSpace(m.Title())
+			artist = strings.TrimSpace(m.Artist())
+			if artist == "" {
+				artist = strings.TrimSpace(m.AlbumArtist())
+			}
+			song.Album = strings.TrimSpace(m.Album())
+			song.ReleaseYear = m.Year()
+			song.Genre = strings.TrimSpace(m.Genre())
+			song.ISRC = rawTag(m, "TSRC", "isrc")
+			song.Tags = fileTags(m)
+		}
+	}
+	song.Title, song.Artist = songName(path, title, artist)
+	return song
+}
+
+// rawTag returns the first of the named raw tags that is set.
+func rawTag(m tag.Metadata, names ...string) string {
+	for _, name := range names {
+		if value, ok := m.Raw()[name].(string); ok && strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// fileTags returns the tags worth keeping that have no field of their own.
+func fileTags(m tag.Metadata) map[string]string {
+	tags := map[string]string{}
+	if v := strings.TrimSpace(m.AlbumArtist()); v != "" {
+		tags["albumArtist"] = v
+	}
+	if v := strings.TrimSpace(m.Composer()); v != "" {
+		tags["composer"] = v
+	}
+	if track, total := m.Track(); track > 0 {
+		tags["track"] = strconv.Itoa(track)
+		if total > 0 {
+			tags["track"] += "/" + strconv.Itoa(total)
+		}
+	}
+	if disc, total := m.Disc(); disc > 0 {
+		tags["disc"] = strconv.Itoa(disc)
+		if total > 0 {
+			tags["disc"] += "/" + strconv.Itoa(total)
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// songName completes the title and artist read from tags from the file
+// name of path.
+func songName(path, title, artist string) (string, string) {
+	if title != "" && artist != "" {
+		return title, artist
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name = trackNumberPrefix.ReplaceAllString(name, "")
+	if a, t, ok := strings.Cut(name, " - "); ok {
+		if artist == "" {
+			artist = strings.TrimSpace(a)
+		}
+		if title == "" {
+			title = strings.TrimSpace(t)
+		}
+	}
+
+	if title == "" {
+		title = strings.TrimSpace(name)
+	}
+	if artist == "" {
+		artist = "Unknown"
+	}
+	return title, artist
+}
@@ -4,14 +4,55 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"shazam/db"
+	waveid "shazam/process"
+	"time"
 )
 
 const (
 	SONGS_DIR   = "songs"
 	MAX_WORKERS = 5
 	DB_PATH     = "shazam.db"
+	BOLT_PATH   = "shazam.bolt"
+	// CONFIG_ENV names a JSON file overriding the default fingerprint config.
+	CONFIG_ENV = "WAVEID_CONFIG"
+	// STORE_ENV selects the store backend: sqlite (default), bolt or memory.
+	STORE_ENV = "WAVEID_STORE"
 )
 
+// fpConfig is the fingerprint config used by every command.
+var fpConfig = waveid.DefaultConfig()
+
+// openStore opens the fingerprint store selected by STORE_ENV.
+func openStore() (db.FingerprintStore, error) {
+	switch backend := os.Getenv(STORE_ENV); backend {
+	case db.StoreBolt:
+		return db.Open(backend, BOLT_PATH)
+	case db.StoreMemory:
+		return db.Open(backend, "default")
+	default:
+		return db.Open(backend, DB_PATH)
+	}
+}
+
+// withStore opens the store, passes it to run and closes it again. Commands
+// call it only once their arguments are valid, so that a usage error never
+// creates or migrates a database. An error from run is printed after the
+// store is closed, and the process exits with status 1.
+func withStore(run func(store db.FingerprintStore) error) {
+	store, err := openStore()
+	if err != nil {
+		fmt.Printf("Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	err = run(store)
+	store.Close()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
 func main() {
 	fmt.Println("Starting the Project Server...")
 
@@ -25,29 +66,145 @@ func main() {
 		os.Exit(1)
 	}
 
+	if path := os.Getenv(CONFIG_ENV); path != "" {
+		fpConfig, err = waveid.LoadConfig(path)
+		if err != nil {
+			fmt.Printf("Error loading fingerprint config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	switch os.Args[1] {
 	case "find":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: main.go find <path_to_wav_file>")
+		findCmd := flag.NewFlagSet("find", flag.ExitOnError)
+		threshold := findCmd.Float64("threshold", waveid.DefaultThreshold, "Minimum match confidence between 0 and 1 (0 lists every candidate)")
+		stopRatio := findCmd.Float64("stop-ratio", waveid.DefaultStopHashRatio, "Skip addresses found in more than this fraction of songs (0 disables)")
+		idf := findCmd.Bool("idf", true, "Weight hits by how rare their address is in the catalog")
+		verbose := findCmd.Bool("v", false, "Print the match diagnostics of every candidate")
+		timeline := findCmd.Bool("timeline", false, "Identify every song in a long recording and print a tracklist")
+		window := findCmd.Duration("window", 10*time.Second, "Timeline analysis window length")
+		hop := findCmd.Duration("hop", 5*time.Second, "Timeline analysis window step")
+		format := findCmd.String("format", "text", "Timeline output format: text, json or csv")
+		scaleDefaults := waveid.DefaultScaleOptions()
+		speed := findCmd.Float64("speed", 0, fmt.Sprintf("Search speed changes of up to this fraction, e.g. %.1f for ±%.0f%% (0 disables)", scaleDefaults.MaxChange, scaleDefaults.MaxChange*100))
+		speedStep := findCmd.Float64("speed-step", scaleDefaults.Step, "Step between searched speed factors")
+		pitch := findCmd.String("pitch", scaleDefaults.Pitch, "How pitch relates to speed: follow, keep or search")
+		findCmd.Parse(os.Args[2:])
+		if findCmd.NArg() < 1 {
+			fmt.Println("Usage: main.go find [-threshold 0.5] [-stop-ratio 0.02] [-idf=true] [-v] [-speed 0.1 [-speed-step 0.01] [-pitch follow|keep|search]] [-timeline [-window 10s] [-hop 5s] [-format text|json|csv]] <path_to_audio_file>")
+			os.Exit(1)
+		}
+		if err := checkTimelineFlags(findCmd, *timeline); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		scale := waveid.ScaleOptions{MaxChange: *speed, Step: *speedStep, Pitch: *pitch}
+		if err := scale.Validate(); *speed > 0 && err != nil {
+			fmt.Println("Error:", err)
 			os.Exit(1)
 		}
-		filePath := os.Args[2]
-		find(filePath)
+		matchOpts := waveid.MatchOptions{Threshold: *threshold, StopHashRatio: *stopRatio, IDF: *idf}
+		if *timeline {
+			opts := waveid.DefaultTimelineOptions()
+			opts.WindowMs = uint32(window.Milliseconds())
+			opts.HopMs = uint32(hop.Milliseconds())
+			opts.Match = matchOpts
+			withStore(func(store db.FingerprintStore) error {
+				findTimeline(store, findCmd.Arg(0), opts, *format)
+				return nil
+			})
+			break
+		}
+		withStore(func(store db.FingerprintStore) error {
+			find(store, findCmd.Arg(0), matchOpts, scale, *verbose)
+			return nil
+		})
 	case "download":
 		if len(os.Args) < 3 {
 			fmt.Println("Usage: go run main.go download example.json")
 			os.Exit(1)
 		}
 		url := os.Args[2]
-		download(url)
+		withStore(func(store db.FingerprintStore) error {
+			download(store, url)
+			return nil
+		})
+	case "index":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: go run main.go index <music_dir>")
+			os.Exit(1)
+		}
+		withStore(func(store db.FingerprintStore) error {
+			indexDirectory(store, os.Args[2])
+			return nil
+		})
+	case "dupes":
+		dupesCmd := flag.NewFlagSet("dupes", flag.ExitOnError)
+		defaults := waveid.DefaultDuplicateOptions()
+		overlap := dupesCmd.Float64("overlap", defaults.MinOverlap, "Minimum fraction of each song's hashes found in the other song")
+		confidence := dupesCmd.Float64("confidence", defaults.MinConfidence, "Minimum confidence that the overlap is at a consistent offset")
+		duration := dupesCmd.Float64("duration", defaults.MinDurationRatio, "Minimum length of the shorter song as a fraction of the longer one")
+		remove := dupesCmd.Bool("delete", false, "Delete all but the most complete song of each group")
+		merge := dupesCmd.Bool("merge", false, "Like -delete, but first copy missing metadata to the kept song")
+		dupesCmd.Parse(os.Args[2:])
+		opts := waveid.DuplicateOptions{MinOverlap: *overlap, MinConfidence: *confidence, MinDurationRatio: *duration}
+		withStore(func(store db.FingerprintStore) error {
+			findDuplicates(store, opts, *remove, *merge)
+			return nil
+		})
+	case "songs":
+		manageSongs(os.Args[2:])
+	case "catalog":
+		manageCatalog(os.Args[2:])
+	case "migrate":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: go run main.go migrate status|up")
+			os.Exit(1)
+		}
+		migrateDatabase(os.Args[2])
+	case "config":
+		withStore(func(store db.FingerprintStore) error {
+			showConfig(store)
+			return nil
+		})
+	case "peaks":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: go run main.go peaks <audio_file>")
+			os.Exit(1)
+		}
+		comparePeakPickers(os.Args[2])
 	case "serve":
 		serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
 		protocol := serveCmd.String("proto", "http", "Protocol to use (http or https)")
 		port := serveCmd.String("p", "5000", "Port to use")
+		threshold := serveCmd.Float64("threshold", waveid.DefaultThreshold, "Minimum match confidence between 0 and 1")
+		stopRatio := serveCmd.Float64("stop-ratio", waveid.DefaultStopHashRatio, "Skip addresses found in more than this fraction of songs (0 disables)")
+		idf := serveCmd.Bool("idf", true, "Weight hits by how rare their address is in the catalog")
+		useIndex := serveCmd.Bool("index", false, "Serve lookups from an in-memory index instead of SQLite")
+		snapshot := serveCmd.String("index-snapshot", "", "Index snapshot file to map at startup and keep up to date")
+		refresh := serveCmd.Duration("index-refresh", 30*time.Second, "How often the in-memory index picks up new songs (0 disables)")
 		serveCmd.Parse(os.Args[2:])
-		serve(*protocol, *port)
+
+		opts := waveid.MatchOptions{Threshold: *threshold, StopHashRatio: *stopRatio, IDF: *idf}
+		withStore(func(store db.FingerprintStore) error {
+			if *useIndex {
+				if err := waveid.CheckConfig(store, fpConfig, false); err != nil {
+					return err
+				}
+
+				ix, err := loadPostingIndex(store, *snapshot)
+				if err != nil {
+					return fmt.Errorf("Error loading in-memory index: %v", err)
+				}
+				defer ix.Close()
+				go refreshPostingIndex(ix, store, *refresh)
+				opts.Postings = ix
+			}
+			serve(store, *protocol, *port, opts)
+			return nil
+		})
 	default:
-		fmt.Println("Unknown command. Available commands: find")
+		fmt.Println("Unknown command. Available commands: find, download, index, dupes, songs, catalog, migrate, config, peaks, serve")
 	}
 
 }
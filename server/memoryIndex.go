@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"shazam/db"
+	"shazam/index"
+	"time"
+)
+
+// loadPostingIndex builds the in-memory index served by serve -index. With
+// a snapshot path, the snapshot is used when it exists and matches the
+// fingerprint config, and is rewritten otherwise. Songs added to the
+// database after the snapshot was written are picked up right away.
+func loadPostingIndex(dbClient db.FingerprintStore, snapshotPath string) (*index.Index, error) {
+	startTime := time.Now()
+	tag := fpConfig.ID()
+
+	var ix *index.Index
+	if snapshotPath != "" {
+		var err error
+		ix, err = index.OpenSnapshot(snapshotPath, tag)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Ignoring index snapshot", "path", snapshotPath, "error", err)
+		}
+	}
+
+	fromSnapshot := ix != nil
+	if !fromSnapshot {
+		var err error
+		if ix, err = index.Load(dbClient); err != nil {
+			return nil, err
+		}
+	}
+
+	added, removed, err := ix.Sync(dbClient)
+	if err != nil {
+		ix.Close()
+		return nil, err
+	}
+
+	if snapshotPath != "" && (!fromSnapshot || added > 0 || removed > 0) {
+		if err := ix.WriteSnapshot(snapshotPath, tag); err != nil {
+			slog.Warn("Failed to write index snapshot", "path", snapshotPath, "error", err)
+		}
+	}
+
+	fingerprints, _ := ix.TotalFingerprints()
+	slog.Info("Loaded in-memory index", "songs", ix.TotalSongs(), "fingerprints", fingerprints,
+		"fromSnapshot", fromSnapshot, "took", time.Since(startTime))
+	return ix, nil
+}
+
+// refreshPostingIndex keeps ix in sync with the database every interval so
+// songs ingested by other processes become searchable without a restart.
+// An interval of zero or less disables the refresh.
+func refreshPostingIndex(ix *index.Index, dbClient db.FingerprintStore, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		added, removed, err := ix.Sync(dbClient)
+		if err != nil {
+			slog.Error("Failed to refresh in-memory index", "error", err)
+			continue
+		}
+		if added > 0 || removed > 0 {
+			slog.Info("Refreshed in-memory index", "added", added, "removed", removed)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"shazam/db"
+)
+
+// migrateDatabase shows or applies the schema migrations of the SQLite
+// database. Other stores have no schema to migrate.
+func migrateDatabase(action string) {
+	if backend := os.Getenv(STORE_ENV); backend != "" && backend != db.StoreSQLite {
+		fmt.Printf("The %s store has no schema migrations.\n", backend)
+		return
+	}
+
+	switch action {
+	case "status":
+		status, err := db.SchemaStatus(DB_PATH)
+		if err != nil {
+			fmt.Println("Error reading schema version:", err)
+			return
+		}
+
+		current, pending := 0, 0
+		for _, m := range status {
+			if m.AppliedAt.IsZero() {
+				pending++
+			} else {
+				current = m.Version
+			}
+		}
+		fmt.Printf("%s is at schema version %d of %d\n", DB_PATH, current, status[len(status)-1].Version)
+		for _, m := range status {
+			state := "pending"
+			if !m.AppliedAt.IsZero() {
+				state = "applied " + m.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("  %3d  %-50s %s\n", m.Version, m.Description, state)
+		}
+		if pending > 0 {
+			fmt.Printf("\n%d pending migrations; run \"migrate up\" to apply them.\n", pending)
+		}
+	case "up":
+		applied, backup, err := db.Migrate(DB_PATH)
+		if backup != "" {
+			fmt.Println("Backed up database to", backup)
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied migration %d: %s\n", m.Version, m.Description)
+		}
+		if err != nil {
+			fmt.Println("Error migrating database:", err)
+			return
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database schema is up to date.")
+		}
+	default:
+		fmt.Println("Usage: main.go migrate status|up")
+	}
+}
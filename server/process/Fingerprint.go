@@ -5,116 +5,149 @@ import (
 	"shazam/db"
 	"shazam/types"
 	"shazam/utils"
+	"slices"
 	"sort"
 	"time"
 )
 
-const (
-	maxFreqBits    = 9
-	maxDeltaBits   = 14
-	targetZoneSize = 5
-)
-
-func createAddress(anchor, target Peak) uint32 {
-	anchorFreqBin := uint32(anchor.Freq / 10) // Scale down to fit in 9 bits
+func createAddress(anchor, target Peak, cfg FingerprintConfig) uint32 {
+	anchorFreqBin := uint32(anchor.Freq / 10) // Scale down to fit in maxFreqBits
 	targetFreqBin := uint32(target.Freq / 10)
 
 	deltaMsRaw := uint32((target.Time - anchor.Time) * 1000)
 
 	// Mask to fit within bit constraints
-	anchorFreqBits := anchorFreqBin & ((1 << maxFreqBits) - 1) // 9 bits
-	targetFreqBits := targetFreqBin & ((1 << maxFreqBits) - 1) // 9 bits
-	deltaBits := deltaMsRaw & ((1 << maxDeltaBits) - 1)        // 14 bits (max ~16 seconds)
+	freqMask := uint32(1)<<cfg.MaxFreqBits - 1
+	deltaMask := uint32(1)<<cfg.MaxDeltaBits - 1 // 14 bits by default (max ~16 seconds)
 
 	// Combine into 32-bit address
-	address := (anchorFreqBits << 23) | (targetFreqBits << 14) | deltaBits
+	address := (anchorFreqBin&freqMask)<<(cfg.MaxFreqBits+cfg.MaxDeltaBits) |
+		(targetFreqBin&freqMask)<<cfg.MaxDeltaBits |
+		deltaMsRaw&deltaMask
 
 	return address
 }
 
-func Extract(peaks []Peak, songID uint32) map[uint32]types.Couple {
-	fingerprints := map[uint32]types.Couple{}
+// Extract pairs every peak with the TargetZoneSize peaks that follow it.
+// Every pair is kept, so an address repeated at several anchor times, e.g.
+// in a chorus, keeps all of its occurrences.
+func Extract(peaks []Peak, cfg FingerprintConfig) []types.Hash {
+	var fingerprints []types.Hash
 
 	for i, anchor := range peaks {
-		for j := i + 1; j < len(peaks) && j <= i+targetZoneSize; j++ {
+		for j := i + 1; j < len(peaks) && j <= i+cfg.TargetZoneSize; j++ {
 			target := peaks[j]
 
-			address := createAddress(anchor, target)
+			address := createAddress(anchor, target, cfg)
 			anchorTimeMs := uint32(anchor.Time * 1000)
 
-			fingerprints[address] = types.Couple{
+			fingerprints = append(fingerprints, types.Hash{
+				Address:      address,
 				AnchorTimeMs: anchorTimeMs,
-				SongID:       songID,
-			}
+			})
 		}
 	}
 
 	return fingerprints
 }
 
-func Fingerprint(filePath string, songID uint32) (map[uint32]types.Couple, error) {
-	wavFilePath, err := utils.ConvertToWAV(filePath)
-	if err != nil {
-		return map[uint32]types.Couple{}, fmt.Errorf("WAV conversion failed: %v", err)
-	}
-	wavInfo, err := utils.ReadWavInfo(wavFilePath)
+// Fingerprint streams the audio file at filePath through the fingerprint
+// pipeline without holding the decoded samples in memory.
+func Fingerprint(filePath string, cfg FingerprintConfig) ([]types.Hash, error) {
+	fingerprints, _, err := FingerprintFile(filePath, cfg)
+	return fingerprints, err
+}
+
+// FingerprintFile is Fingerprint that also returns the length of the audio
+// in milliseconds.
+func FingerprintFile(filePath string, cfg FingerprintConfig) ([]types.Hash, uint32, error) {
+	reader, err := utils.OpenAudioWithOptions(filePath, cfg.Downmix)
 	if err != nil {
-		return nil, fmt.Errorf("error reading WAV info: %v", err)
+		return nil, 0, fmt.Errorf("error decoding audio: %v", err)
 	}
+	defer reader.Close()
 
-	spectro, err := Spectrogram(wavInfo.LeftChannelSamples, wavInfo.SampleRate)
+	fp, err := NewStreamFingerprinter(reader.SampleRate(), cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error generating spectrogram: %v", err)
+		return nil, 0, err
 	}
-	peaks := ExtractPeaks(spectro, wavInfo.Duration, wavInfo.SampleRate)
-	return Extract(peaks, songID), nil
+	var fingerprints []types.Hash
+	fp.OnHash = func(hash types.Hash) {
+		fingerprints = append(fingerprints, hash)
+	}
+	if err := fp.Consume(reader); err != nil {
+		return nil, 0, err
+	}
+	return fingerprints, fp.DurationMs(), nil
 }
 
 // FindMatchesFGP uses the sample fingerprint to find matching songs in the database.
-func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]types.Match, time.Duration, error) {
+// Only songs whose confidence reaches opts.Threshold are returned, best first.
+// It fails with ErrConfigMismatch if the database was built with a different cfg.
+func FindMatchesFGP(store db.FingerprintStore, sampleFingerprint []types.Hash, cfg FingerprintConfig, opts MatchOptions) ([]types.Match, time.Duration, error) {
 	startTime := time.Now()
-	addresses := make([]uint32, 0, len(sampleFingerprint))
-	for address := range sampleFingerprint {
-		addresses = append(addresses, address)
+	if err := CheckConfig(store, cfg, false); err != nil {
+		return nil, 0, err
 	}
-	db, err := db.DBClient("shazam.db")
-	if err != nil {
+	var postings PostingSource = store
+	if opts.Postings != nil {
+		postings = opts.Postings
+	}
+
+	var stats catalogStats
+	var err error
+	if stats.songs, err = store.TotalSongs(); err != nil {
 		return nil, 0, err
 	}
-	defer db.Close()
-	m, err := db.GetCouples(addresses)
-	if err != nil {
+	if stats.fingerprints, err = postings.TotalFingerprints(); err != nil {
 		return nil, 0, err
 	}
-	matches := map[uint32][][2]uint32{}        // songID -> [(sampleTime, dbTime)]
-	timestamps := map[uint32]uint32{}          // songID -> earliest timestamp
-	targetZones := map[uint32]map[uint32]int{} // songID -> timestamp -> count
 
-	for address, couples := range m {
-		for _, couple := range couples {
-			matches[couple.SongID] = append(
-				matches[couple.SongID],
-				[2]uint32{sampleFingerprint[address], couple.AnchorTimeMs},
-			)
+	weights, err := addressWeights(postings, sampleFingerprint, stats.songs, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	skipped := 0
+	for _, hash := range sampleFingerprint {
+		if weights != nil && weights[hash.Address] == 0 {
+			skipped++
+		}
+	}
 
-			if existingTime, ok := timestamps[couple.SongID]; !ok || couple.AnchorTimeMs < existingTime {
-				timestamps[couple.SongID] = couple.AnchorTimeMs
-			}
+	alignments, err := alignQuery(postings, sampleFingerprint, weights)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Scores add up hit weights, so random hits are expected to weigh as
+	// much as the average query hash.
+	randomHits := stats.randomHits(len(sampleFingerprint)-skipped, cfg) * meanWeight(sampleFingerprint, weights)
 
-			if _, ok := targetZones[couple.SongID]; !ok {
-				targetZones[couple.SongID] = make(map[uint32]int)
-			}
-			targetZones[couple.SongID][couple.AnchorTimeMs]++
+	// The runner-up of the best song is the second best; every other song
+	// competes with the best.
+	var bestID uint32
+	var best, second float64
+	for songID, alignment := range alignments {
+		if points := alignment.score; points > best {
+			bestID, best, second = songID, points, best
+		} else if points > second {
+			second = points
 		}
 	}
-	// matches = filterMatches(10, matches, targetZones)
-
-	scores := analyzeRelativeTiming(matches)
 
 	var matchList []types.Match
 
-	for songID, points := range scores {
-		song, songExists, err := db.GetSongByID(songID)
+	for songID, alignment := range alignments {
+		points := alignment.score
+		runnerUp := best
+		if songID == bestID {
+			runnerUp = second
+		}
+		conf := confidence(points, runnerUp, randomHits)
+		if conf < opts.Threshold {
+			continue
+		}
+
+		song, songExists, err := store.GetSongByID(songID)
 		if !songExists {
 			continue
 		}
@@ -122,7 +155,25 @@ func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]types.Match, time.Du
 			continue
 		}
 
-		match := types.Match{SongID: songID, SongTitle: song.Title, SongArtist: song.Artist, YouTubeID: song.YouTubeID, Timestamp: timestamps[songID], Score: points}
+		match := types.Match{
+			SongID:           songID,
+			SongTitle:        song.Title,
+			SongArtist:       song.Artist,
+			YouTubeID:        song.YouTubeID,
+			SongMetadata:     song.SongMetadata,
+			Timestamp:        alignment.position(),
+			Score:            points,
+			Confidence:       conf,
+			SpeedFactor:      1,
+			PitchFactor:      1,
+			HashHits:         alignment.hits,
+			QueryHashes:      len(sampleFingerprint),
+			SkippedHashes:    skipped,
+			BestBinCount:     alignment.count,
+			RunnerUpBinCount: alignment.runnerUpCount,
+			MatchedSpanMs:    alignment.spanMs,
+			Coverage:         min(1, float64(alignment.covered)/float64(len(sampleFingerprint))),
+		}
 		matchList = append(matchList, match)
 	}
 
@@ -133,31 +184,180 @@ func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]types.Match, time.Du
 	return matchList, time.Since(startTime), nil
 }
 
-func analyzeRelativeTiming(matches map[uint32][][2]uint32) map[uint32]float64 {
-	scores := make(map[uint32]float64)
+// alignQuery looks up every hash of sample in postings and aligns each
+// song that shares any with it. Hits count as the weight of their address,
+// or 1 if weights is nil; addresses weighing 0 are skipped.
+func alignQuery(postings PostingSource, sample []types.Hash, weights map[uint32]float64) (map[uint32]alignment, error) {
+	sampleTimes := map[uint32][]uint32{} // address -> sample anchor times
+	addresses := make([]uint32, 0, len(sample))
+	for _, hash := range sample {
+		if weights != nil && weights[hash.Address] == 0 {
+			continue
+		}
+		if _, ok := sampleTimes[hash.Address]; !ok {
+			addresses = append(addresses, hash.Address)
+		}
+		sampleTimes[hash.Address] = append(sampleTimes[hash.Address], hash.AnchorTimeMs)
+	}
+
+	m, err := postings.GetCouples(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := map[uint32][][3]uint32{} // songID -> [(sampleTime, dbTime, address)]
+	for address, couples := range m {
+		for _, couple := range couples {
+			for _, sampleTime := range sampleTimes[address] {
+				matches[couple.SongID] = append(
+					matches[couple.SongID],
+					[3]uint32{sampleTime, couple.AnchorTimeMs, address},
+				)
+			}
+		}
+	}
+
+	return analyzeRelativeTiming(matches, weights), nil
+}
+
+// alignment is the best time alignment of a song with the query.
+type alignment struct {
+	// score is the weight of the hash pairs in the winning offset window,
+	// and count their number.
+	score float64
+	count int
+	// offsetMs is the song time minus the query time of those pairs, i.e.
+	// where in the song the query starts.
+	offsetMs int32
+	// hits is the number of hash pairs of the song at any offset.
+	hits int
+	// runnerUp and runnerUpCount describe the best window that does not
+	// overlap the winning one.
+	runnerUp      float64
+	runnerUpCount int
+	// spanMs is the distance between the first and last song time of the
+	// pairs in the winning window.
+	spanMs uint32
+	// covered is the number of distinct query hashes in the winning window.
+	covered int
+}
+
+// position is offsetMs clamped to the start of the song, for queries that
+// begin slightly before the song does.
+func (a alignment) position() uint32 {
+	return uint32(max(a.offsetMs, 0))
+}
+
+// offsetBucket bins offsets in 100ms buckets to allow for small timing
+// variations. It rounds down, so offsets just below zero, from queries
+// starting before the song, get a bucket of their own instead of sharing
+// bucket 0 with the offsets just above it.
+func offsetBucket(offset int32) int32 {
+	bucket := offset / 100
+	if offset%100 < 0 {
+		bucket--
+	}
+	return bucket
+}
+
+// bucketTally is the number and total weight of the pairs in a bucket.
+type bucketTally struct {
+	count  int
+	weight float64
+}
+
+// analyzeRelativeTiming finds, for every song, the window of two adjacent
+// offset buckets holding the most weight, so an alignment straddling a
+// bucket boundary is not split between two buckets. Pairs weigh as their
+// address in weights, or 1 if weights is nil.
+func analyzeRelativeTiming(matches map[uint32][][3]uint32, weights map[uint32]float64) map[uint32]alignment {
+	alignments := make(map[uint32]alignment)
 
 	for songID, times := range matches {
-		offsetCounts := make(map[int32]int)
+		offsetTallies := make(map[int32]bucketTally)
 
 		for _, timePair := range times {
 			sampleTime := int32(timePair[0])
 			dbTime := int32(timePair[1])
-			offset := dbTime - sampleTime
+			weight := 1.0
+			if weights != nil {
+				weight = weights[timePair[2]]
+			}
+
+			bucket := offsetBucket(dbTime - sampleTime)
+			tally := offsetTallies[bucket]
+			tally.count++
+			tally.weight += weight
+			offsetTallies[bucket] = tally
+		}
+
+		// window sums the buckets bucket and bucket+1.
+		window := func(bucket int32) bucketTally {
+			a, b := offsetTallies[bucket], offsetTallies[bucket+1]
+			return bucketTally{a.count + b.count, a.weight + b.weight}
+		}
 
-			// Bin offsets in 100ms buckets to allow for small timing variations
-			offsetBucket := offset / 100
-			offsetCounts[offsetBucket]++
+		// Ties go to the earliest window so results do not depend on map order.
+		var best bucketTally
+		var bestBucket int32
+		for bucket := range offsetTallies {
+			for _, start := range []int32{bucket - 1, bucket} {
+				if w := window(start); w.weight > best.weight || (w.weight == best.weight && start < bestBucket) {
+					best = w
+					bestBucket = start
+				}
+			}
 		}
 
-		maxCount := 0
-		for _, count := range offsetCounts {
-			if count > maxCount {
-				maxCount = count
+		var runnerUp bucketTally
+		for bucket := range offsetTallies {
+			for _, start := range []int32{bucket - 1, bucket} {
+				if start < bestBucket-1 || start > bestBucket+1 {
+					if w := window(start); w.weight > runnerUp.weight {
+						runnerUp = w
+					}
+				}
 			}
 		}
 
-		scores[songID] = float64(maxCount)
+		alignment := refineOffset(times, bestBucket)
+		alignment.score = best.weight
+		alignment.count = best.count
+		alignment.hits = len(times)
+		alignment.runnerUp = runnerUp.weight
+		alignment.runnerUpCount = runnerUp.count
+		alignments[songID] = alignment
 	}
 
-	return scores
+	return alignments
+}
+
+// refineOffset sets offsetMs to the median exact offset of the pairs in the
+// window starting at bucket, which is robust against the odd pair at the
+// window edge, and fills in the song time and query hashes they cover. With
+// no pair in the window, the alignment is left empty.
+func refineOffset(times [][3]uint32, bucket int32) alignment {
+	var offsets []int32
+	first, last := ^uint32(0), uint32(0)
+	queryHashes := make(map[[2]uint32]struct{})
+	for _, timePair := range times {
+		offset := int32(timePair[1]) - int32(timePair[0])
+		if b := offsetBucket(offset); b == bucket || b == bucket+1 {
+			offsets = append(offsets, offset)
+			first = min(first, timePair[1])
+			last = max(last, timePair[1])
+			queryHashes[[2]uint32{timePair[2], timePair[0]}] = struct{}{}
+		}
+	}
+
+	if len(offsets) == 0 {
+		return alignment{}
+	}
+
+	slices.Sort(offsets)
+	return alignment{
+		offsetMs: offsets[len(offsets)/2],
+		spanMs:   last - first,
+		covered:  len(queryHashes),
+	}
 }
@@ -0,0 +1,43 @@
+package waveid
+
+import "testing"
+
+func TestOffsetBucket(t *testing.T) {
+	tests := []struct {
+		offset int32
+		want   int32
+	}{
+		{0, 0},
+		{99, 0},
+		{100, 1},
+		{-1, -1},
+		{-99, -1},
+		{-100, -1},
+		{-101, -2},
+	}
+	for _, test := range tests {
+		if got := offsetBucket(test.offset); got != test.want {
+			t.Errorf("offsetBucket(%d) = %d, want %d", test.offset, got, test.want)
+		}
+	}
+}
+
+func TestRefineOffset(t *testing.T) {
+	// Pairs of query time, song time and query address.
+	times := [][3]uint32{
+		{0, 1000, 1}, {100, 1110, 2}, {200, 1190, 3}, {300, 1320, 4},
+		{400, 9000, 5},
+	}
+
+	// The window holds the offsets 1000, 1010, 990 and 1020, but not 8600.
+	got := refineOffset(times, offsetBucket(990))
+	want := alignment{offsetMs: 1010, spanMs: 320, covered: 4}
+	if got != want {
+		t.Errorf("refineOffset = %+v, want %+v", got, want)
+	}
+
+	// No pair falls into the window.
+	if got := refineOffset(times, offsetBucket(-5000)); got != (alignment{}) {
+		t.Errorf("refineOffset with an empty window = %+v, want an empty alignment", got)
+	}
+}
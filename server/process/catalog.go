@@ -0,0 +1,398 @@
+package waveid
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"shazam/db"
+	"shazam/types"
+	"shazam/utils"
+	"time"
+)
+
+// BundleVersion is the version of the catalog bundle layout written by
+// ExportCatalog. Bump it when the layout changes; ImportCatalog reads every
+// version up to it. Version 2 added the song metadata besides the title,
+// artist and YouTube ID.
+const BundleVersion = 2
+
+// bundleFormat tells catalog bundles apart from any other zip file.
+const bundleFormat = "waveid-catalog"
+
+// Files of a catalog bundle. Every song's hashes are stored in their own
+// file under bundleFingerprintsDir.
+const (
+	bundleManifestFile    = "manifest.json"
+	bundleSongsFile       = "songs.jsonl"
+	bundleFingerprintsDir = "fingerprints/"
+)
+
+// hashRecordSize is the size of one hash in a fingerprint file: the address
+// and the anchor time as little-endian uint32s.
+const hashRecordSize = 8
+
+// ErrInvalidBundle is returned when a file is not a catalog bundle this
+// version can read, or when its contents fail their checksums.
+var ErrInvalidBundle = errors.New("invalid catalog bundle")
+
+// BundleManifest describes a catalog bundle. It is stored as manifest.json.
+type BundleManifest struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Config is the fingerprint config every hash of the bundle was made
+	// with; ConfigID is its digest.
+	Config       FingerprintConfig `json:"config"`
+	ConfigID     string            `json:"configId"`
+	Songs        int               `json:"songs"`
+	Fingerprints int               `json:"fingerprints"`
+	// Checksums maps every other file of the bundle to its SHA-256 digest.
+	Checksums map[string]string `json:"checksums"`
+}
+
+// bundleSong is one line of songs.jsonl.
+type bundleSong struct {
+	ID        uint32 `json:"id"`
+	Title     string `json:"title"`
+	Artist    string `json:"artist"`
+	YouTubeID string `json:"youtubeId,omitempty"`
+
+	Album       string            `json:"album,omitempty"`
+	DurationMs  uint32            `json:"durationMs,omitempty"`
+	ReleaseYear int               `json:"releaseYear,omitempty"`
+	ISRC        string            `json:"isrc,omitempty"`
+	Genre       string            `json:"genre,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	IngestedAt  time.Time         `json:"ingestedAt,omitzero"`
+	Tags        map[string]string `json:"tags,omitempty"`
+
+	// Fingerprints is the bundle file holding the song's hashes.
+	Fingerprints string `json:"fingerprints"`
+}
+
+// newBundleSong describes song for songs.jsonl.
+func newBundleSong(song types.Song, fingerprints string) bundleSong {
+	return bundleSong{
+		ID:           song.ID,
+		Title:        song.Title,
+		Artist:       song.Artist,
+		YouTubeID:    song.YouTubeID,
+		Album:        song.Album,
+		DurationMs:   song.DurationMs,
+		ReleaseYear:  song.ReleaseYear,
+		ISRC:         song.ISRC,
+		Genre:        song.Genre,
+		Source:       song.Source,
+		IngestedAt:   song.IngestedAt,
+		Tags:         song.Tags,
+		Fingerprints: fingerprints,
+	}
+}
+
+// song returns the song a line of songs.jsonl describes.
+func (s bundleSong) song() types.Song {
+	return types.Song{
+		ID:        s.ID,
+		Title:     s.Title,
+		Artist:    s.Artist,
+		YouTubeID: s.YouTubeID,
+		SongMetadata: types.SongMetadata{
+			Album:       s.Album,
+			DurationMs:  s.DurationMs,
+			ReleaseYear: s.ReleaseYear,
+			ISRC:        s.ISRC,
+			Genre:       s.Genre,
+			Source:      s.Source,
+			IngestedAt:  s.IngestedAt,
+			Tags:        s.Tags,
+		},
+	}
+}
+
+// ImportResult counts what ImportCatalog did.
+type ImportResult struct {
+	Imported int
+	// Skipped is the number of songs already in the catalog by title and
+	// artist; Remapped the number imported under a new ID because theirs
+	// was taken.
+	Skipped      int
+	Remapped     int
+	Fingerprints int
+}
+
+// ExportCatalog writes every song of the store, its hashes and the
+// fingerprint config they were made with to w as a zip bundle.
+func ExportCatalog(store db.FingerprintStore, w io.Writer) (BundleManifest, error) {
+	cfg, ok, err := StoredConfig(store)
+	if err != nil {
+		return BundleManifest{}, err
+	}
+	if !ok {
+		return BundleManifest{}, errors.New("database has no fingerprint config to export")
+	}
+
+	songs, err := store.ListSongs()
+	if err != nil {
+		return BundleManifest{}, err
+	}
+
+	manifest := BundleManifest{
+		Format:    bundleFormat,
+		Version:   BundleVersion,
+		CreatedAt: time.Now().UTC(),
+		Config:    cfg,
+		ConfigID:  cfg.ID(),
+		Checksums: map[string]string{},
+	}
+
+	zw := zip.NewWriter(w)
+	// writeFile adds a file to the bundle and records its checksum.
+	writeFile := func(name string, data []byte) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return fmt.Errorf("error adding %s to bundle: %s", name, err)
+		}
+		if _, err := f.Write(data); err != nil {
+			return fmt.Errorf("error writing %s to bundle: %s", name, err)
+		}
+		sum := sha256.Sum256(data)
+		manifest.Checksums[name] = hex.EncodeToString(sum[:])
+		return nil
+	}
+
+	var songLines bytes.Buffer
+	enc := json.NewEncoder(&songLines)
+	for _, song := range songs {
+		hashes, err := store.GetSongFingerprints(song.ID)
+		if err != nil {
+			return BundleManifest{}, err
+		}
+
+		name := fmt.Sprintf("%s%d.bin", bundleFingerprintsDir, song.ID)
+		if err := writeFile(name, encodeHashes(hashes)); err != nil {
+			return BundleManifest{}, err
+		}
+		if err := enc.Encode(newBundleSong(song, name)); err != nil {
+			return BundleManifest{}, err
+		}
+		manifest.Songs++
+		manifest.Fingerprints += len(hashes)
+	}
+	if err := writeFile(bundleSongsFile, songLines.Bytes()); err != nil {
+		return BundleManifest{}, err
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return BundleManifest{}, err
+	}
+	f, err := zw.Create(bundleManifestFile)
+	if err != nil {
+		return BundleManifest{}, fmt.Errorf("error adding %s to bundle: %s", bundleManifestFile, err)
+	}
+	if _, err := f.Write(b); err != nil {
+		return BundleManifest{}, fmt.Errorf("error writing %s to bundle: %s", bundleManifestFile, err)
+	}
+	if err := zw.Close(); err != nil {
+		return BundleManifest{}, fmt.Errorf("error finishing bundle: %s", err)
+	}
+	return manifest, nil
+}
+
+// ImportCatalog adds the songs of the bundle in r to the store. It checks
+// every checksum before changing anything, and the bundle's fingerprint
+// config must be cfg, the config in use, which in turn must be the one the
+// store was built with; an empty store records it. Songs whose title and
+// artist are already in the store are skipped, and songs whose ID is taken
+// get a new one, so catalogs built separately can be merged.
+//
+// The import is not atomic: songs are added one at a time, and those added
+// before an error stay in the store. A song whose hashes cannot be stored
+// is removed again, so running the import once more picks up where it
+// stopped.
+func ImportCatalog(store db.FingerprintStore, cfg FingerprintConfig, r io.ReaderAt, size int64) (ImportResult, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	manifest, files, err := readManifest(zr)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	for name := range manifest.Checksums {
+		if _, err := readBundleFile(files, manifest, name); err != nil {
+			return ImportResult{}, err
+		}
+	}
+	if !reflect.DeepEqual(manifest.Config, cfg) {
+		return ImportResult{}, fmt.Errorf("%w: bundle uses config %s, current config is %s",
+			ErrConfigMismatch, manifest.Config.ID(), cfg.ID())
+	}
+	if err := CheckConfig(store, cfg, true); err != nil {
+		return ImportResult{}, err
+	}
+
+	data, err := readBundleFile(files, manifest, bundleSongsFile)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	var result ImportResult
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record bundleSong
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return result, fmt.Errorf("%w: %s line %d: %v", ErrInvalidBundle, bundleSongsFile, line, err)
+		}
+
+		exists, err := store.SongExists(utils.GenerateSongKey(record.Title, record.Artist))
+		if err != nil {
+			return result, err
+		}
+		if exists {
+			result.Skipped++
+			continue
+		}
+
+		b, err := readBundleFile(files, manifest, record.Fingerprints)
+		if err != nil {
+			return result, err
+		}
+		hashes, err := decodeHashes(b)
+		if err != nil {
+			return result, fmt.Errorf("%w: %s: %v", ErrInvalidBundle, record.Fingerprints, err)
+		}
+
+		songID, err := store.RegisterSong(record.song())
+		if errors.Is(err, db.ErrSongExists) {
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if err := store.StoreFingerprints(songID, hashes); err != nil {
+			if delErr := store.DeleteSong(songID); delErr != nil {
+				return result, fmt.Errorf("%v (cleanup failed: %v)", err, delErr)
+			}
+			return result, err
+		}
+
+		result.Imported++
+		result.Fingerprints += len(hashes)
+		if songID != record.ID {
+			result.Remapped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("%w: %s: %v", ErrInvalidBundle, bundleSongsFile, err)
+	}
+	return result, nil
+}
+
+// readManifest parses and checks the manifest of a bundle and returns it
+// with the bundle's files by name.
+func readManifest(zr *zip.Reader) (BundleManifest, map[string]*zip.File, error) {
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	f, ok := files[bundleManifestFile]
+	if !ok {
+		return BundleManifest{}, nil, fmt.Errorf("%w: no %s", ErrInvalidBundle, bundleManifestFile)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return BundleManifest{}, nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	defer rc.Close()
+
+	var manifest BundleManifest
+	if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return BundleManifest{}, nil, fmt.Errorf("%w: error parsing %s: %v", ErrInvalidBundle, bundleManifestFile, err)
+	}
+	switch {
+	case manifest.Format != bundleFormat:
+		return BundleManifest{}, nil, fmt.Errorf("%w: format %q is not %q", ErrInvalidBundle, manifest.Format, bundleFormat)
+	case manifest.Version < 1 || manifest.Version > BundleVersion:
+		return BundleManifest{}, nil, fmt.Errorf("%w: version %d, this build reads versions up to %d",
+			ErrInvalidBundle, manifest.Version, BundleVersion)
+	case manifest.ConfigID != manifest.Config.ID():
+		return BundleManifest{}, nil, fmt.Errorf("%w: config does not match its ID %s", ErrInvalidBundle, manifest.ConfigID)
+	}
+	if err := manifest.Config.Validate(); err != nil {
+		return BundleManifest{}, nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	if _, ok := manifest.Checksums[bundleSongsFile]; !ok {
+		return BundleManifest{}, nil, fmt.Errorf("%w: no checksum for %s", ErrInvalidBundle, bundleSongsFile)
+	}
+	return manifest, files, nil
+}
+
+// readBundleFile returns the contents of a bundle file after checking them
+// against the manifest's checksum.
+func readBundleFile(files map[string]*zip.File, manifest BundleManifest, name string) ([]byte, error) {
+	sum, ok := manifest.Checksums[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: no checksum for %s", ErrInvalidBundle, name)
+	}
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidBundle, name)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error reading %s: %v", ErrInvalidBundle, name, err)
+	}
+
+	actual := sha256.Sum256(data)
+	if hex.EncodeToString(actual[:]) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch for %s", ErrInvalidBundle, name)
+	}
+	return data, nil
+}
+
+// encodeHashes serializes hashes as fingerprint file records.
+func encodeHashes(hashes []types.Hash) []byte {
+	b := make([]byte, 0, len(hashes)*hashRecordSize)
+	for _, hash := range hashes {
+		b = binary.LittleEndian.AppendUint32(b, hash.Address)
+		b = binary.LittleEndian.AppendUint32(b, hash.AnchorTimeMs)
+	}
+	return b
+}
+
+// decodeHashes parses the records of a fingerprint file.
+func decodeHashes(b []byte) ([]types.Hash, error) {
+	if len(b)%hashRecordSize != 0 {
+		return nil, fmt.Errorf("size %d is not a multiple of %d", len(b), hashRecordSize)
+	}
+	hashes := make([]types.Hash, 0, len(b)/hashRecordSize)
+	for ; len(b) > 0; b = b[hashRecordSize:] {
+		hashes = append(hashes, types.Hash{
+			Address:      binary.LittleEndian.Uint32(b),
+			AnchorTimeMs: binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return hashes, nil
+}
@@ -0,0 +1,41 @@
+package waveid
+
+import (
+	"bytes"
+	"errors"
+	"shazam/db"
+	"testing"
+)
+
+func TestImportCatalogConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	var bundle bytes.Buffer
+	if _, err := ExportCatalog(timelineStore(t, cfg), &bundle); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(bundle.Bytes())
+
+	// An empty store must not adopt the bundle's config when it is not the
+	// one in use.
+	other := cfg
+	other.MaxFreqBits--
+	store := db.MemoryClient(t.Name() + "/other")
+	if _, err := ImportCatalog(store, other, r, r.Size()); !errors.Is(err, ErrConfigMismatch) {
+		t.Fatalf("import with another config: err = %v, want ErrConfigMismatch", err)
+	}
+	if _, ok, err := StoredConfig(store); ok || err != nil {
+		t.Fatalf("rejected import recorded a config (err %v)", err)
+	}
+
+	store = db.MemoryClient(t.Name() + "/same")
+	result, err := ImportCatalog(store, cfg, r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 2 {
+		t.Fatalf("imported %d songs, want 2", result.Imported)
+	}
+	if err := CheckConfig(store, cfg, false); err != nil {
+		t.Fatal(err)
+	}
+}
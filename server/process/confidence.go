@@ -0,0 +1,78 @@
+package waveid
+
+import (
+	"math"
+	"shazam/types"
+)
+
+// DefaultThreshold is the confidence a match needs unless configured otherwise.
+const DefaultThreshold = 0.5
+
+// significanceScale is how many standard deviations above the random-hit
+// rate a score must be for its significance to reach 1-1/e.
+const significanceScale = 4.0
+
+// PostingSource serves the postings FindMatchesFGP scores and the document
+// frequencies it weighs them by. The database is the default source; an
+// in-memory index can stand in for it.
+type PostingSource interface {
+	GetCouples(addresses []uint32) (map[uint32][]types.Couple, error)
+	TotalFingerprints() (int, error)
+	DocumentFrequencies(addresses []uint32) (map[uint32]int, error)
+}
+
+// MatchOptions controls how FindMatchesFGP looks up and decides on matches.
+type MatchOptions struct {
+	// Threshold is the minimum confidence, between 0 and 1, a song needs to
+	// be reported. With 0 every candidate is returned.
+	Threshold float64
+	// Postings, if set, is queried instead of the database.
+	Postings PostingSource
+	// StopHashRatio, if above zero, skips query addresses that occur in
+	// more than this fraction of the catalog's songs; see addressWeights.
+	StopHashRatio float64
+	// IDF weights every hit by how rare its address is in the catalog, so
+	// that common addresses count less towards the score.
+	IDF bool
+}
+
+// DefaultStopHashRatio is the StopHashRatio used unless configured otherwise.
+const DefaultStopHashRatio = 0.02
+
+// DefaultMatchOptions returns the options used unless configured otherwise.
+func DefaultMatchOptions() MatchOptions {
+	return MatchOptions{Threshold: DefaultThreshold, StopHashRatio: DefaultStopHashRatio, IDF: true}
+}
+
+// catalogStats describes the database a query is matched against.
+type catalogStats struct {
+	songs        int
+	fingerprints int
+}
+
+// randomHits is the number of hashes a query of queryHashes is expected to
+// share with one song by chance, assuming addresses are spread evenly over
+// the address space. It is never below one.
+func (c catalogStats) randomHits(queryHashes int, cfg FingerprintConfig) float64 {
+	if c.songs == 0 {
+		return 1
+	}
+	addressSpace := math.Ldexp(1, 2*cfg.MaxFreqBits+cfg.MaxDeltaBits)
+	perSong := float64(c.fingerprints) / float64(c.songs)
+	return math.Max(1, float64(queryHashes)*perSong/addressSpace)
+}
+
+// confidence combines how far score stands out from the best competing
+// song with how unlikely score is to come from random hits. The result is
+// between 0 and 1.
+func confidence(score, runnerUp, randomHits float64) float64 {
+	if score <= randomHits || score <= runnerUp {
+		return 0
+	}
+
+	margin := (score - runnerUp) / score
+	z := (score - randomHits) / math.Sqrt(randomHits)
+	significance := 1 - math.Exp(-z/significanceScale)
+
+	return margin * significance
+}
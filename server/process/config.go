@@ -0,0 +1,218 @@
+package waveid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"shazam/db"
+	"shazam/utils"
+)
+
+// AlgorithmVersion identifies the fingerprint algorithm itself. Bump it when
+// a code change alters the hashes produced for the same parameters.
+const AlgorithmVersion = 1
+
+// configMetadataKey is where the config is stored in the metadata table.
+const configMetadataKey = "fingerprint_config"
+
+// ErrConfigMismatch is returned when a database was built with different
+// fingerprint parameters than the ones in use.
+var ErrConfigMismatch = errors.New("fingerprint config does not match the database")
+
+// PeakBand is a range [Min, Max) of spectrogram bins searched for a peak.
+type PeakBand struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// FingerprintConfig holds every parameter that affects the hashes stored in
+// the database. Songs and queries must be fingerprinted with the same config.
+type FingerprintConfig struct {
+	Version int `json:"version"`
+
+	// Downmix selects how multichannel input is folded to mono. It is left
+	// out of the JSON when it averages all channels, the default.
+	Downmix utils.WavOptions `json:"downmix,omitzero"`
+
+	// SampleRate is the rate every input is resampled to before the STFT.
+	SampleRate int `json:"sampleRate"`
+	WindowSize int `json:"windowSize"`
+	HopSize    int `json:"hopSize"`
+	// WindowType is "hanning" or "hamming".
+	WindowType string `json:"windowType"`
+
+	// AntiAlias is the low-pass run before resampling. Its cutoff, the
+	// highest frequency kept, must lie below half of SampleRate.
+	AntiAlias FilterSpec `json:"antiAlias"`
+	// PreFilter, if set, runs before the anti-aliasing filter, e.g. a
+	// high-pass to strip rumble and handling noise from phone recordings.
+	// Its cutoffs must lie below half of SampleRate.
+	PreFilter FilterSpec `json:"preFilter,omitzero"`
+
+	// PeakPicker selects how peaks are picked from the spectrogram, see
+	// PeakPickers. The constellation picker searches the span of PeakBands.
+	PeakPicker    string              `json:"peakPicker"`
+	PeakBands     []PeakBand          `json:"peakBands"`
+	Constellation ConstellationConfig `json:"constellation"`
+
+	TargetZoneSize int `json:"targetZoneSize"`
+	MaxFreqBits    int `json:"maxFreqBits"`
+	MaxDeltaBits   int `json:"maxDeltaBits"`
+}
+
+// DefaultConfig returns the parameters used unless configured otherwise.
+func DefaultConfig() FingerprintConfig {
+	return FingerprintConfig{
+		Version:    AlgorithmVersion,
+		SampleRate: 11025,
+		WindowSize: 1024,
+		HopSize:    512, // 50% overlap for better time-frequency resolution
+		WindowType: "hanning",
+		AntiAlias:  FilterSpec{Design: FilterButterworth, Kind: LowPass, Order: 8, Cutoff: 5000},
+		PeakPicker: PeakPickerBand,
+		PeakBands: []PeakBand{
+			{0, 10}, {10, 20}, {20, 40}, {40, 80}, {80, 160}, {160, 512},
+		},
+		Constellation:  ConstellationConfig{TimeRadius: 5, FreqRadius: 10, MinMagnitude: 1},
+		TargetZoneSize: 5,
+		MaxFreqBits:    9,
+		MaxDeltaBits:   14,
+	}
+}
+
+// LoadConfig reads a JSON config from path. Fields missing from the file
+// keep their DefaultConfig values.
+func LoadConfig(path string) (FingerprintConfig, error) {
+	cfg := DefaultConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("error parsing fingerprint config %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid fingerprint config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate reports parameters the pipeline cannot work with.
+func (c FingerprintConfig) Validate() error {
+	switch {
+	case c.Version != AlgorithmVersion:
+		return fmt.Errorf("config is for algorithm version %d, this build implements version %d", c.Version, AlgorithmVersion)
+	case c.SampleRate <= 0:
+		return errors.New("sampleRate must be positive")
+	case !isPowerOfTwo(c.WindowSize) || c.WindowSize < 4:
+		return fmt.Errorf("windowSize must be a power of two, got %d", c.WindowSize)
+	case c.HopSize <= 0 || c.HopSize > c.WindowSize:
+		return fmt.Errorf("hopSize must be between 1 and windowSize, got %d", c.HopSize)
+	case c.WindowType != "hanning" && c.WindowType != "hamming":
+		return fmt.Errorf("unknown windowType %q", c.WindowType)
+	case c.Downmix.Validate() != nil:
+		return c.Downmix.Validate()
+	case validFilter(c.AntiAlias, c.SampleRate) != nil:
+		return fmt.Errorf("invalid antiAlias: %v", validFilter(c.AntiAlias, c.SampleRate))
+	case c.PreFilter != FilterSpec{} && validFilter(c.PreFilter, c.SampleRate) != nil:
+		return fmt.Errorf("invalid preFilter: %v", validFilter(c.PreFilter, c.SampleRate))
+	case c.PeakPicker != PeakPickerBand && c.PeakPicker != PeakPickerConstellation:
+		return fmt.Errorf("unknown peakPicker %q", c.PeakPicker)
+	case len(c.PeakBands) == 0:
+		return errors.New("at least one peak band is required")
+	case c.Constellation.TimeRadius < 0 || c.Constellation.FreqRadius < 0:
+		return errors.New("constellation radii must not be negative")
+	case c.Constellation.MinMagnitude < 0:
+		return errors.New("constellation minMagnitude must not be negative")
+	case c.TargetZoneSize <= 0:
+		return errors.New("targetZoneSize must be positive")
+	case c.MaxFreqBits <= 0 || c.MaxDeltaBits <= 0 || 2*c.MaxFreqBits+c.MaxDeltaBits > 32:
+		return fmt.Errorf("2*maxFreqBits+maxDeltaBits must fit in 32 bits, got %d", 2*c.MaxFreqBits+c.MaxDeltaBits)
+	}
+
+	for _, band := range c.PeakBands {
+		if band.Min < 0 || band.Max <= band.Min || band.Max > c.WindowSize/2 {
+			return fmt.Errorf("peak band [%d, %d) must lie within [0, %d)", band.Min, band.Max, c.WindowSize/2)
+		}
+	}
+	return nil
+}
+
+// validFilter reports whether spec can be built for audio at sampleRate.
+func validFilter(spec FilterSpec, sampleRate int) error {
+	_, err := NewFilter(spec, float64(sampleRate))
+	return err
+}
+
+// ID is a short digest of the config, handy for telling catalogs apart.
+func (c FingerprintConfig) ID() string {
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:6])
+}
+
+// frameDuration is the time in seconds between two spectrogram frames.
+func (c FingerprintConfig) frameDuration() float64 {
+	return float64(c.HopSize) / float64(c.SampleRate)
+}
+
+// freqResolution is the width in Hz of one spectrogram bin.
+func (c FingerprintConfig) freqResolution() float64 {
+	return float64(c.SampleRate) / float64(c.WindowSize)
+}
+
+// StoredConfig returns the config recorded in the database, if any.
+func StoredConfig(store db.FingerprintStore) (FingerprintConfig, bool, error) {
+	value, ok, err := store.GetMetadata(configMetadataKey)
+	if err != nil || !ok {
+		return FingerprintConfig{}, false, err
+	}
+
+	var cfg FingerprintConfig
+	if err := json.Unmarshal([]byte(value), &cfg); err != nil {
+		return FingerprintConfig{}, false, fmt.Errorf("error parsing stored fingerprint config: %v", err)
+	}
+	return cfg, true, nil
+}
+
+// CheckConfig fails with ErrConfigMismatch unless the database was built
+// with cfg. A database without a stored config only passes while it is
+// empty; with record set, cfg is then stored for later checks.
+func CheckConfig(store db.FingerprintStore, cfg FingerprintConfig, record bool) error {
+	stored, ok, err := StoredConfig(store)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if !reflect.DeepEqual(stored, cfg) {
+			storedJSON, _ := json.Marshal(stored)
+			cfgJSON, _ := json.Marshal(cfg)
+			return fmt.Errorf("%w: database uses config %s %s, current config is %s %s",
+				ErrConfigMismatch, stored.ID(), storedJSON, cfg.ID(), cfgJSON)
+		}
+		return nil
+	}
+
+	totalSongs, err := store.TotalSongs()
+	if err != nil {
+		return err
+	}
+	if totalSongs > 0 {
+		return fmt.Errorf("%w: database holds %d songs but no fingerprint config; it was built by an older version and must be rebuilt",
+			ErrConfigMismatch, totalSongs)
+	}
+
+	if !record {
+		return nil
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return store.SetMetadata(configMetadataKey, string(b))
+}
@@ -0,0 +1,189 @@
+package waveid
+
+import (
+	"cmp"
+	"maps"
+	"shazam/db"
+	"shazam/types"
+	"slices"
+)
+
+// DuplicateOptions controls what FindDuplicates reports as duplicates.
+type DuplicateOptions struct {
+	// MinOverlap is the fraction of each song's hashes that must hit the
+	// other song at a single offset, checked in both directions.
+	MinOverlap float64
+	// MinConfidence is how clearly that offset must stand out from every
+	// other offset, on the same scale as the match confidence.
+	MinConfidence float64
+	// MinDurationRatio is the shortest length the shorter song may have,
+	// as a fraction of the longer one.
+	MinDurationRatio float64
+}
+
+// DefaultDuplicateOptions returns the options used unless configured otherwise.
+func DefaultDuplicateOptions() DuplicateOptions {
+	return DuplicateOptions{MinOverlap: 0.2, MinConfidence: DefaultThreshold, MinDurationRatio: 0.5}
+}
+
+// DuplicatePair records that two songs were found inside each other.
+type DuplicatePair struct {
+	SongID  uint32
+	OtherID uint32
+	// Overlap is the fraction of SongID's hashes found in OtherID, and
+	// ReverseOverlap the fraction of OtherID's hashes found in SongID.
+	Overlap        float64
+	ReverseOverlap float64
+	// OffsetMs is where in OtherID the song starts.
+	OffsetMs int32
+	// Confidence is the lower confidence of the two directions.
+	Confidence float64
+}
+
+// DuplicateGroup is a song worth keeping, Songs[0], and the songs that are
+// copies or versions of it. Every other song was matched directly with
+// Songs[0], as recorded in Pairs, so deleting it loses nothing.
+type DuplicateGroup struct {
+	Songs []types.Song
+	Pairs []DuplicatePair
+}
+
+// match is one direction of a duplicate pair: a song found in another.
+type match struct {
+	overlap    float64
+	offsetMs   int32
+	confidence float64
+}
+
+// FindDuplicates matches every song of the catalog against all others, as
+// if it were a query, and pairs the songs that substantially overlap each
+// other at a consistent offset and are of similar length, such as
+// re-uploads, remasters and radio edits. Songs with the most hashes are
+// kept first, and each keeps the unclaimed songs it was paired with;
+// songs related only through a chain of pairs are not grouped.
+func FindDuplicates(store db.FingerprintStore, cfg FingerprintConfig, opts DuplicateOptions) ([]DuplicateGroup, error) {
+	if err := CheckConfig(store, cfg, false); err != nil {
+		return nil, err
+	}
+	ids, err := store.SongIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats catalogStats
+	if stats.songs, err = store.TotalSongs(); err != nil {
+		return nil, err
+	}
+	if stats.fingerprints, err = store.TotalFingerprints(); err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[uint32]int, len(ids))
+	matches := map[[2]uint32]match{} // (song, other) -> song found in other
+	for _, id := range ids {
+		hashes, err := store.GetSongFingerprints(id)
+		if err != nil {
+			return nil, err
+		}
+		sizes[id] = len(hashes)
+
+		alignments, err := alignQuery(store, hashes, nil)
+		if err != nil {
+			return nil, err
+		}
+		randomHits := stats.randomHits(len(hashes), cfg)
+		for otherID, alignment := range alignments {
+			if otherID == id {
+				continue
+			}
+			m := match{
+				overlap:    float64(alignment.covered) / float64(len(hashes)),
+				offsetMs:   alignment.offsetMs,
+				confidence: confidence(alignment.score, alignment.runnerUp, randomHits),
+			}
+			if m.overlap >= opts.MinOverlap && m.confidence >= opts.MinConfidence {
+				matches[[2]uint32{id, otherID}] = m
+			}
+		}
+	}
+
+	songs := make(map[uint32]types.Song, len(ids))
+	for _, id := range ids {
+		song, ok, err := store.GetSongByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			song = types.Song{ID: id}
+		}
+		songs[id] = song
+	}
+
+	// Keep only pairs found in both directions, of songs of similar length.
+	paired := map[uint32][]DuplicatePair{}
+	for key, m := range matches {
+		songID, otherID := key[0], key[1]
+		reverse, ok := matches[[2]uint32{otherID, songID}]
+		if !ok || !similarLength(songs[songID], songs[otherID], sizes, opts.MinDurationRatio) {
+			continue
+		}
+		paired[otherID] = append(paired[otherID], DuplicatePair{
+			SongID:         songID,
+			OtherID:        otherID,
+			Overlap:        m.overlap,
+			ReverseOverlap: reverse.overlap,
+			OffsetMs:       m.offsetMs,
+			Confidence:     min(m.confidence, reverse.confidence),
+		})
+	}
+
+	byKeep := slices.SortedFunc(maps.Keys(paired), func(a, b uint32) int {
+		return cmp.Or(cmp.Compare(sizes[b], sizes[a]), cmp.Compare(a, b))
+	})
+	claimed := map[uint32]bool{}
+	var groups []DuplicateGroup
+	for _, keepID := range byKeep {
+		if claimed[keepID] {
+			continue
+		}
+		group := DuplicateGroup{Songs: []types.Song{songs[keepID]}}
+		for _, pair := range paired[keepID] {
+			if !claimed[pair.SongID] {
+				group.Pairs = append(group.Pairs, pair)
+			}
+		}
+		if len(group.Pairs) == 0 {
+			continue
+		}
+		slices.SortFunc(group.Pairs, func(a, b DuplicatePair) int {
+			return cmp.Or(cmp.Compare(b.Overlap, a.Overlap), cmp.Compare(a.SongID, b.SongID))
+		})
+
+		claimed[keepID] = true
+		for _, pair := range group.Pairs {
+			claimed[pair.SongID] = true
+			group.Songs = append(group.Songs, songs[pair.SongID])
+		}
+		groups = append(groups, group)
+	}
+
+	slices.SortFunc(groups, func(a, b DuplicateGroup) int {
+		return cmp.Or(cmp.Compare(a.Songs[0].Artist, b.Songs[0].Artist),
+			cmp.Compare(a.Songs[0].Title, b.Songs[0].Title), cmp.Compare(a.Songs[0].ID, b.Songs[0].ID))
+	})
+	return groups, nil
+}
+
+// similarLength reports whether the shorter of two songs is at least
+// minRatio of the longer one. Songs without a recorded duration are
+// compared by their number of hashes instead.
+func similarLength(a, b types.Song, sizes map[uint32]int, minRatio float64) bool {
+	x, y := float64(a.DurationMs), float64(b.DurationMs)
+	if x == 0 || y == 0 {
+		x, y = float64(sizes[a.ID]), float64(sizes[b.ID])
+	}
+	if x == 0 || y == 0 {
+		return false
+	}
+	return min(x, y)/max(x, y) >= minRatio
+}
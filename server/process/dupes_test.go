@@ -0,0 +1,70 @@
+package waveid
+
+import (
+	"fmt"
+	"shazam/db"
+	"shazam/types"
+	"slices"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	cfg := DefaultConfig()
+	store := db.MemoryClient(t.Name())
+	if err := CheckConfig(store, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every song is a sequence of 20s pieces of material; the songID of a
+	// piece names the material, so songs that share material share hashes.
+	songs := []struct {
+		id       uint32
+		material []uint32
+	}{
+		// 1 and 2 share half of their material, as do 2 and 3, but 1 and
+		// 3 share nothing: 3 must not be grouped with 1 through 2.
+		{1, []uint32{10, 11}},
+		{2, []uint32{11, 12}},
+		{3, []uint32{12, 13}},
+		// 4 is entirely inside 5, but five times shorter.
+		{4, []uint32{20}},
+		{5, []uint32{20, 21, 22, 23, 24}},
+	}
+	for _, song := range songs {
+		var pieces []piece
+		for i, material := range song.material {
+			pieces = append(pieces, piece{songID: material, fromMs: 0, toMs: 20000, atMs: uint32(i) * 20000})
+		}
+		_, err := store.RegisterSong(types.Song{ID: song.id, Title: fmt.Sprintf("Song %d", song.id),
+			SongMetadata: types.SongMetadata{DurationMs: uint32(len(pieces)) * 20000}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.StoreFingerprints(song.id, recording(pieces...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := FindDuplicates(store, cfg, DefaultDuplicateOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("found %d groups, want 1: %+v", len(groups), groups)
+	}
+	var ids []uint32
+	for _, song := range groups[0].Songs {
+		ids = append(ids, song.ID)
+	}
+	if !slices.Equal(ids, []uint32{1, 2}) {
+		t.Fatalf("group holds songs %v, want 1 kept and 2 as its duplicate", ids)
+	}
+
+	pair := groups[0].Pairs[0]
+	if pair.SongID != 2 || pair.OtherID != 1 || pair.OffsetMs != 20000 {
+		t.Fatalf("pair = %+v, want song 2 found in song 1 at 20s", pair)
+	}
+	if pair.Overlap != 0.5 || pair.ReverseOverlap != 0.5 {
+		t.Fatalf("pair overlaps = %.2f and %.2f, want 0.5 both ways", pair.Overlap, pair.ReverseOverlap)
+	}
+}
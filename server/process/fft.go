@@ -2,41 +2,187 @@ package waveid
 
 import (
 	"math"
+	"math/bits"
+	"math/cmplx"
+	"sync"
 )
 
-func FFT(input []float64) []complex128 {
-	complexArray := make([]complex128, len(input))
-	for i, v := range input {
-		complexArray[i] = complex(v, 0)
+// fftPlan caches the bit-reversal permutation and twiddle factors of one
+// power-of-two transform size.
+type fftPlan struct {
+	n        int
+	bitrev   []int
+	twiddles []complex128 // exp(-2*pi*i*k/n) for k < n
+}
+
+var fftPlans sync.Map // int -> *fftPlan
+
+func getFFTPlan(n int) *fftPlan {
+	if p, ok := fftPlans.Load(n); ok {
+		return p.(*fftPlan)
 	}
 
-	fftResult := make([]complex128, len(complexArray))
-	copy(fftResult, complexArray)
-	return recursiveFFT(fftResult)
+	logN := bits.TrailingZeros(uint(n))
+	p := &fftPlan{
+		n:        n,
+		bitrev:   make([]int, n),
+		twiddles: make([]complex128, n),
+	}
+	for i := range p.bitrev {
+		p.bitrev[i] = int(bits.Reverse(uint(i)) >> (bits.UintSize - logN))
+	}
+	for k := range p.twiddles {
+		theta := -2 * math.Pi * float64(k) / float64(n)
+		p.twiddles[k] = complex(math.Cos(theta), math.Sin(theta))
+	}
+
+	actual, _ := fftPlans.LoadOrStore(n, p)
+	return actual.(*fftPlan)
 }
 
-func recursiveFFT(complexArray []complex128) []complex128 {
-	N := len(complexArray)
-	if N <= 1 {
-		return complexArray
+// transform runs an in-place iterative decimation-in-time FFT. Each
+// radix-4 pass does the work of two radix-2 passes with three twiddle
+// multiplications per butterfly instead of four; a single radix-2 pass
+// comes first when log2(n) is odd.
+func (p *fftPlan) transform(x []complex128) {
+	for i, j := range p.bitrev {
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
 	}
 
-	even := make([]complex128, N/2)
-	odd := make([]complex128, N/2)
-	for i := 0; i < N/2; i++ {
-		even[i] = complexArray[2*i]
-		odd[i] = complexArray[2*i+1]
+	// quarter is the length of the transforms already computed.
+	quarter := 1
+	if bits.TrailingZeros(uint(p.n))%2 == 1 {
+		for start := 0; start < p.n; start += 2 {
+			u, t := x[start], x[start+1]
+			x[start] = u + t
+			x[start+1] = u - t
+		}
+		quarter = 2
+	}
+
+	for ; quarter*4 <= p.n; quarter *= 4 {
+		size := quarter * 4
+		stride := p.n / size
+		for start := 0; start < p.n; start += size {
+			for k := 0; k < quarter; k++ {
+				i0, i1, i2, i3 := start+k, start+k+quarter, start+k+2*quarter, start+k+3*quarter
+
+				// The four inputs are the bit-reversed sub-transforms of
+				// the samples at n = 0, 2, 1, 3 (mod 4) of this block.
+				a := x[i0]
+				b := p.twiddles[2*k*stride] * x[i1]
+				c := p.twiddles[k*stride] * x[i2]
+				d := p.twiddles[3*k*stride] * x[i3]
+
+				sum, diff := a+b, a-b
+				cd := c + d
+				// rot is -i*(c-d).
+				rot := complex(imag(c)-imag(d), real(d)-real(c))
+				x[i0] = sum + cd
+				x[i2] = sum - cd
+				x[i1] = diff + rot
+				x[i3] = diff - rot
+			}
+		}
+	}
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// FFT returns the complex spectrum of a real signal. Power-of-two lengths
+// use the cached iterative transform; other lengths fall back to a direct DFT.
+func FFT(input []float64) []complex128 {
+	n := len(input)
+	fftResult := make([]complex128, n)
+	if n == 0 {
+		return fftResult
 	}
 
-	even = recursiveFFT(even)
-	odd = recursiveFFT(odd)
+	if !isPowerOfTwo(n) {
+		for k := range fftResult {
+			var sum complex128
+			for t, v := range input {
+				theta := -2 * math.Pi * float64(k*t%n) / float64(n)
+				sum += complex(v*math.Cos(theta), v*math.Sin(theta))
+			}
+			fftResult[k] = sum
+		}
+		return fftResult
+	}
 
-	fftResult := make([]complex128, N)
-	for k := 0; k < N/2; k++ {
-		t := complex(math.Cos(-2*math.Pi*float64(k)/float64(N)), math.Sin(-2*math.Pi*float64(k)/float64(N)))
-		fftResult[k] = even[k] + t*odd[k]
-		fftResult[k+N/2] = even[k] - t*odd[k]
+	if n < 4 {
+		for i, v := range input {
+			fftResult[i] = complex(v, 0)
+		}
+		getFFTPlan(n).transform(fftResult)
+		return fftResult
 	}
 
+	// Compute bins 0..n/2 with the real FFT and mirror the rest.
+	r := newRealFFT(n)
+	r.transform(input)
+	copy(fftResult, r.spectrum)
+	fftResult[n/2] = r.nyquist
+	for k := n/2 + 1; k < n; k++ {
+		fftResult[k] = cmplx.Conj(fftResult[n-k])
+	}
 	return fftResult
 }
+
+// realFFT computes the first half of the spectrum of a real signal of
+// length n with a single complex FFT of length n/2. Its buffers are reused
+// between calls, so one realFFT must not be shared between goroutines.
+type realFFT struct {
+	n    int
+	half *fftPlan
+	// twiddles are exp(-2*pi*i*k/n) for k < n/2.
+	twiddles []complex128
+	work     []complex128
+	// spectrum holds bins 0..n/2-1 after transform; nyquist holds bin n/2.
+	spectrum []complex128
+	nyquist  complex128
+}
+
+func newRealFFT(n int) *realFFT {
+	full := getFFTPlan(n)
+	return &realFFT{
+		n:        n,
+		half:     getFFTPlan(n / 2),
+		twiddles: full.twiddles[:n/2],
+		work:     make([]complex128, n/2),
+		spectrum: make([]complex128, n/2),
+	}
+}
+
+func (r *realFFT) transform(input []float64) {
+	h := r.n / 2
+
+	// Pack even samples into the real part and odd ones into the imaginary.
+	for i := 0; i < h; i++ {
+		r.work[i] = complex(input[2*i], input[2*i+1])
+	}
+	r.half.transform(r.work)
+
+	// Split the packed spectrum into the even and odd spectra and combine.
+	for k := 0; k < h; k++ {
+		z := r.work[k]
+		zc := cmplx.Conj(r.work[(h-k)%h])
+		even := (z + zc) * 0.5
+		odd := (z - zc) * complex(0, -0.5)
+		r.spectrum[k] = even + r.twiddles[k]*odd
+	}
+	z0 := r.work[0]
+	r.nyquist = complex(real(z0)-imag(z0), 0)
+}
+
+// magnitudes writes |X[k]| for k < n/2 into out.
+func (r *realFFT) magnitudes(input []float64, out []float64) {
+	r.transform(input)
+	for k, c := range r.spectrum {
+		out[k] = math.Hypot(real(c), imag(c))
+	}
+}
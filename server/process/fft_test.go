@@ -0,0 +1,224 @@
+package waveid
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// recursiveFFT is the allocating radix-2 FFT the iterative transform
+// replaced. It is kept as the baseline for the benchmarks.
+func recursiveFFT(complexArray []complex128) []complex128 {
+	N := len(complexArray)
+	if N <= 1 {
+		return complexArray
+	}
+
+	even := make([]complex128, N/2)
+	odd := make([]complex128, N/2)
+	for i := 0; i < N/2; i++ {
+		even[i] = complexArray[2*i]
+		odd[i] = complexArray[2*i+1]
+	}
+
+	even = recursiveFFT(even)
+	odd = recursiveFFT(odd)
+
+	fftResult := make([]complex128, N)
+	for k := 0; k < N/2; k++ {
+		t := complex(math.Cos(-2*math.Pi*float64(k)/float64(N)), math.Sin(-2*math.Pi*float64(k)/float64(N)))
+		fftResult[k] = even[k] + t*odd[k]
+		fftResult[k+N/2] = even[k] - t*odd[k]
+	}
+
+	return fftResult
+}
+
+// naiveDFT evaluates the DFT sum directly.
+func naiveDFT(input []complex128) []complex128 {
+	n := len(input)
+	out := make([]complex128, n)
+	for k := range out {
+		for t, v := range input {
+			theta := -2 * math.Pi * float64(k*t%n) / float64(n)
+			out[k] += v * complex(math.Cos(theta), math.Sin(theta))
+		}
+	}
+	return out
+}
+
+func randomSignal(n int, seed int64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	signal := make([]float64, n)
+	for i := range signal {
+		signal[i] = rng.Float64()*2 - 1
+	}
+	return signal
+}
+
+// assertSpectrum fails unless got and want agree to within a tolerance
+// that grows with the transform length.
+func assertSpectrum(t *testing.T, got, want []complex128) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d bins, want %d", len(got), len(want))
+	}
+	tolerance := 1e-9 * float64(len(want))
+	for k := range want {
+		if cmplx.Abs(got[k]-want[k]) > tolerance {
+			t.Fatalf("bin %d = %v, want %v", k, got[k], want[k])
+		}
+	}
+}
+
+func TestFFTMatchesNaiveDFT(t *testing.T) {
+	// Odd and even powers of two exercise the leading radix-2 pass and
+	// the pure radix-4 path; 12 and 100 use the direct DFT fallback.
+	for _, n := range []int{1, 2, 4, 8, 16, 32, 64, 128, 1024, 2048, 12, 100} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			signal := randomSignal(n, int64(n))
+			input := make([]complex128, n)
+			for i, v := range signal {
+				input[i] = complex(v, 0)
+			}
+
+			assertSpectrum(t, FFT(signal), naiveDFT(input))
+		})
+	}
+}
+
+func TestFFTPlanComplexInput(t *testing.T) {
+	for _, n := range []int{2, 4, 8, 16, 512} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			re, im := randomSignal(n, 1), randomSignal(n, 2)
+			input := make([]complex128, n)
+			for i := range input {
+				input[i] = complex(re[i], im[i])
+			}
+
+			got := make([]complex128, n)
+			copy(got, input)
+			getFFTPlan(n).transform(got)
+
+			assertSpectrum(t, got, naiveDFT(input))
+		})
+	}
+}
+
+func TestRealFFTMagnitudes(t *testing.T) {
+	for _, n := range []int{4, 8, 1024} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			signal := randomSignal(n, 3)
+			input := make([]complex128, n)
+			for i, v := range signal {
+				input[i] = complex(v, 0)
+			}
+			want := naiveDFT(input)
+
+			got := make([]float64, n/2)
+			newRealFFT(n).magnitudes(signal, got)
+			for k := range got {
+				if math.Abs(got[k]-cmplx.Abs(want[k])) > 1e-9*float64(n) {
+					t.Fatalf("bin %d magnitude = %v, want %v", k, got[k], cmplx.Abs(want[k]))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFFT(b *testing.B) {
+	for _, n := range []int{1024, 4096} {
+		signal := randomSignal(n, 1)
+
+		b.Run(fmt.Sprintf("recursive/%d", n), func(b *testing.B) {
+			input := make([]complex128, n)
+			for i := 0; i < b.N; i++ {
+				for j, v := range signal {
+					input[j] = complex(v, 0)
+				}
+				recursiveFFT(input)
+			}
+		})
+		b.Run(fmt.Sprintf("iterative/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				FFT(signal)
+			}
+		})
+		b.Run(fmt.Sprintf("real/%d", n), func(b *testing.B) {
+			r := newRealFFT(n)
+			out := make([]float64, n/2)
+			for i := 0; i < b.N; i++ {
+				r.magnitudes(signal, out)
+			}
+		})
+	}
+}
+
+// iterativeSpectrogram filters and resamples sample like the stream
+// fingerprinter and returns the magnitude spectrum of every STFT frame.
+func iterativeSpectrogram(sample []float64, sampleRate int, cfg FingerprintConfig) ([][]float64, error) {
+	filtered := ApplyFilter(newInputFilter(sampleRate, cfg), sample)
+	resampled, err := Resample(filtered, sampleRate, cfg.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+
+	stft := newSTFT(cfg)
+	var spectrogram [][]float64
+	for start := 0; start+cfg.WindowSize <= len(resampled); start += cfg.HopSize {
+		magnitude := make([]float64, cfg.WindowSize/2)
+		stft.magnitudes(resampled[start:start+cfg.WindowSize], magnitude)
+		spectrogram = append(spectrogram, magnitude)
+	}
+	return spectrogram, nil
+}
+
+// recursiveSpectrogram is iterativeSpectrogram with every frame transformed
+// by recursiveFFT, as it was computed before the plans were cached.
+func recursiveSpectrogram(sample []float64, sampleRate int, cfg FingerprintConfig) ([][]float64, error) {
+	filtered := ApplyFilter(newInputFilter(sampleRate, cfg), sample)
+	resampled, err := Resample(filtered, sampleRate, cfg.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+
+	window := newSTFT(cfg).window
+	var spectrogram [][]float64
+	for start := 0; start+cfg.WindowSize <= len(resampled); start += cfg.HopSize {
+		frame := make([]complex128, cfg.WindowSize)
+		for j, w := range window {
+			frame[j] = complex(resampled[start+j]*w, 0)
+		}
+		spectrum := recursiveFFT(frame)
+		magnitude := make([]float64, cfg.WindowSize/2)
+		for j := range magnitude {
+			magnitude[j] = cmplx.Abs(spectrum[j])
+		}
+		spectrogram = append(spectrogram, magnitude)
+	}
+	return spectrogram, nil
+}
+
+func BenchmarkSpectrogram(b *testing.B) {
+	cfg := DefaultConfig()
+	const sampleRate = 44100
+	sample := randomSignal(10*sampleRate, 1)
+
+	for _, bench := range []struct {
+		name        string
+		spectrogram func([]float64, int, FingerprintConfig) ([][]float64, error)
+	}{
+		{"recursive", recursiveSpectrogram},
+		{"iterative", iterativeSpectrogram},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := bench.spectrogram(sample, sampleRate, cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
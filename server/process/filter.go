@@ -0,0 +1,285 @@
+package waveid
+
+import (
+	"fmt"
+	"math"
+)
+
+// Filter designs accepted in FilterSpec.Design.
+const (
+	FilterButterworth = "butterworth"
+	FilterChebyshev   = "chebyshev"
+	FilterFIR         = "fir"
+)
+
+// Filter responses accepted in FilterSpec.Kind.
+const (
+	LowPass  = "lowpass"
+	HighPass = "highpass"
+	BandPass = "bandpass"
+)
+
+// FilterSpec describes a filter to be built by NewFilter.
+type FilterSpec struct {
+	Design string `json:"design"`
+	Kind   string `json:"kind"`
+	// Order is the IIR order, or the number of taps for an FIR filter.
+	Order int `json:"order"`
+	// Cutoff is the -3 dB frequency in Hz (the passband edge for
+	// Chebyshev), or the lower edge of a band-pass filter.
+	Cutoff float64 `json:"cutoff"`
+	// High is the upper edge in Hz of a band-pass filter.
+	High float64 `json:"high,omitempty"`
+	// RippleDB is the passband ripple of a Chebyshev filter.
+	RippleDB float64 `json:"rippleDB,omitempty"`
+}
+
+// Filter processes a signal one sample at a time.
+type Filter interface {
+	Next(x float64) float64
+	Reset()
+}
+
+// NewFilter designs the filter described by spec for the given sample rate.
+// Band-pass filters are built as a high-pass followed by a low-pass.
+func NewFilter(spec FilterSpec, sampleRate float64) (Filter, error) {
+	nyquist := sampleRate / 2
+	if spec.Cutoff <= 0 || spec.Cutoff >= nyquist {
+		return nil, fmt.Errorf("cutoff %.1f Hz must be between 0 and %.1f Hz", spec.Cutoff, nyquist)
+	}
+	if spec.Kind == BandPass && (spec.High <= spec.Cutoff || spec.High >= nyquist) {
+		return nil, fmt.Errorf("band-pass upper edge %.1f Hz must be between %.1f and %.1f Hz", spec.High, spec.Cutoff, nyquist)
+	}
+	if spec.Order < 1 {
+		return nil, fmt.Errorf("filter order must be positive, got %d", spec.Order)
+	}
+
+	switch spec.Design {
+	case FilterButterworth, FilterChebyshev:
+		return newIIRFilter(spec, sampleRate)
+	case FilterFIR:
+		return newFIRFilter(spec, sampleRate)
+	default:
+		return nil, fmt.Errorf("unknown filter design %q", spec.Design)
+	}
+}
+
+// ApplyFilter runs input through f and returns the filtered signal.
+func ApplyFilter(f Filter, input []float64) []float64 {
+	output := make([]float64, len(input))
+	for i, x := range input {
+		output[i] = f.Next(x)
+	}
+	return output
+}
+
+// Biquad is a second-order IIR section in transposed direct form II. A
+// first-order section has b2 = a2 = 0.
+type Biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	z1, z2     float64
+}
+
+func (q *Biquad) Next(x float64) float64 {
+	y := q.b0*x + q.z1
+	q.z1 = q.b1*x - q.a1*y + q.z2
+	q.z2 = q.b2*x - q.a2*y
+	return y
+}
+
+func (q *Biquad) Reset() {
+	q.z1, q.z2 = 0, 0
+}
+
+// Cascade runs its sections in series.
+type Cascade []Filter
+
+func (c Cascade) Next(x float64) float64 {
+	for _, f := range c {
+		x = f.Next(x)
+	}
+	return x
+}
+
+func (c Cascade) Reset() {
+	for _, f := range c {
+		f.Reset()
+	}
+}
+
+func newIIRFilter(spec FilterSpec, sampleRate float64) (Filter, error) {
+	switch spec.Kind {
+	case LowPass, HighPass:
+		return designIIR(spec, spec.Kind, spec.Cutoff, sampleRate)
+	case BandPass:
+		hp, err := designIIR(spec, HighPass, spec.Cutoff, sampleRate)
+		if err != nil {
+			return nil, err
+		}
+		lp, err := designIIR(spec, LowPass, spec.High, sampleRate)
+		if err != nil {
+			return nil, err
+		}
+		return append(hp, lp...), nil
+	default:
+		return nil, fmt.Errorf("unknown filter kind %q", spec.Kind)
+	}
+}
+
+// designIIR places the analog prototype poles of a Butterworth or
+// Chebyshev type I filter, applies the low-pass or high-pass transform and
+// maps every pole pair to a biquad with the prewarped bilinear transform.
+func designIIR(spec FilterSpec, kind string, cutoff, sampleRate float64) (Cascade, error) {
+	n := spec.Order
+	k := math.Tan(math.Pi * cutoff / sampleRate)
+
+	// Poles are sigma +/- j*omega; Butterworth poles sit on the unit circle.
+	sinhMu, coshMu := 1.0, 1.0
+	gain := 1.0
+	if spec.Design == FilterChebyshev {
+		if spec.RippleDB <= 0 {
+			return nil, fmt.Errorf("chebyshev filter needs a positive ripple, got %.2f dB", spec.RippleDB)
+		}
+		eps := math.Sqrt(math.Pow(10, spec.RippleDB/10) - 1)
+		mu := math.Asinh(1/eps) / float64(n)
+		sinhMu, coshMu = math.Sinh(mu), math.Cosh(mu)
+		if n%2 == 0 {
+			// Even orders start at the bottom of the ripple; scale so
+			// the passband peaks at unity.
+			gain = 1 / math.Sqrt(1+eps*eps)
+		}
+	}
+
+	var sections Cascade
+	for i := 0; i < n/2; i++ {
+		theta := math.Pi * float64(2*i+1) / float64(2*n)
+		sigma := -sinhMu * math.Sin(theta)
+		omega := coshMu * math.Cos(theta)
+
+		// Prototype section c / (s^2 + b*s + c).
+		b := -2 * sigma
+		c := sigma*sigma + omega*omega
+
+		var q *Biquad
+		if kind == LowPass {
+			a0 := 1 + b*k + c*k*k
+			g := c * k * k / a0
+			q = &Biquad{b0: g, b1: 2 * g, b2: g,
+				a1: (2*c*k*k - 2) / a0, a2: (1 - b*k + c*k*k) / a0}
+		} else {
+			a0 := k*k + b*k + c
+			g := c / a0
+			q = &Biquad{b0: g, b1: -2 * g, b2: g,
+				a1: (2*k*k - 2*c) / a0, a2: (k*k - b*k + c) / a0}
+		}
+		sections = append(sections, q)
+	}
+
+	if n%2 == 1 {
+		// Real pole of an odd-order prototype: a / (s + a).
+		a := sinhMu
+		var q *Biquad
+		if kind == LowPass {
+			a0 := 1 + a*k
+			q = &Biquad{b0: a * k / a0, b1: a * k / a0, a1: (a*k - 1) / a0}
+		} else {
+			a0 := k + a
+			q = &Biquad{b0: a / a0, b1: -a / a0, a1: (k - a) / a0}
+		}
+		sections = append(sections, q)
+	}
+
+	first := sections[0].(*Biquad)
+	first.b0 *= gain
+	first.b1 *= gain
+	first.b2 *= gain
+
+	return sections, nil
+}
+
+// FIR is a finite impulse response filter with a circular delay line.
+type FIR struct {
+	taps    []float64
+	history []float64
+	pos     int
+}
+
+func (f *FIR) Next(x float64) float64 {
+	f.history[f.pos] = x
+	var y float64
+	idx := f.pos
+	for _, t := range f.taps {
+		y += t * f.history[idx]
+		idx--
+		if idx < 0 {
+			idx = len(f.history) - 1
+		}
+	}
+	f.pos++
+	if f.pos == len(f.history) {
+		f.pos = 0
+	}
+	return y
+}
+
+func (f *FIR) Reset() {
+	for i := range f.history {
+		f.history[i] = 0
+	}
+	f.pos = 0
+}
+
+// newFIRFilter designs a linear-phase Kaiser-windowed sinc filter. The tap
+// count is rounded up to an odd number so high-pass responses are possible.
+// The filter delays the signal by (taps-1)/2 samples.
+func newFIRFilter(spec FilterSpec, sampleRate float64) (Filter, error) {
+	taps := spec.Order | 1
+	m := float64(taps-1) / 2
+
+	// lowPassTaps returns an ideal low-pass at fc (in Hz) with unity DC gain.
+	lowPassTaps := func(fc float64) []float64 {
+		h := make([]float64, taps)
+		norm := fc / sampleRate
+		i0Beta := besselI0(resampleKaiserBeta)
+		var sum float64
+		for i := range h {
+			x := float64(i) - m
+			r := 0.0
+			if m > 0 {
+				r = x / m
+			}
+			window := besselI0(resampleKaiserBeta*math.Sqrt(1-r*r)) / i0Beta
+			h[i] = 2 * norm * sinc(2*norm*x) * window
+			sum += h[i]
+		}
+		for i := range h {
+			h[i] /= sum
+		}
+		return h
+	}
+
+	var h []float64
+	switch spec.Kind {
+	case LowPass:
+		h = lowPassTaps(spec.Cutoff)
+	case HighPass:
+		// Spectral inversion of the matching low-pass.
+		h = lowPassTaps(spec.Cutoff)
+		for i := range h {
+			h[i] = -h[i]
+		}
+		h[taps/2] += 1
+	case BandPass:
+		high := lowPassTaps(spec.High)
+		low := lowPassTaps(spec.Cutoff)
+		h = make([]float64, taps)
+		for i := range h {
+			h[i] = high[i] - low[i]
+		}
+	default:
+		return nil, fmt.Errorf("unknown filter kind %q", spec.Kind)
+	}
+
+	return &FIR{taps: h, history: make([]float64, taps)}, nil
+}
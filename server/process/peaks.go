@@ -0,0 +1,237 @@
+package waveid
+
+import (
+	"fmt"
+	"shazam/utils"
+)
+
+// Peak pickers accepted in FingerprintConfig.PeakPicker.
+const (
+	// PeakPickerBand keeps, per frame, the band maxima above their mean.
+	PeakPickerBand = "band"
+	// PeakPickerConstellation keeps the 2D local maxima of the spectrogram.
+	PeakPickerConstellation = "constellation"
+)
+
+// PeakPickers lists every available peak picker.
+var PeakPickers = []string{PeakPickerBand, PeakPickerConstellation}
+
+// ConstellationConfig tunes the constellation peak picker.
+type ConstellationConfig struct {
+	// TimeRadius and FreqRadius are the half sizes, in frames and bins, of
+	// the neighbourhood a peak must be the maximum of.
+	TimeRadius int `json:"timeRadius"`
+	FreqRadius int `json:"freqRadius"`
+	// MinMagnitude is the amplitude floor; quieter bins are never peaks.
+	MinMagnitude float64 `json:"minMagnitude"`
+}
+
+// PeakPicker selects peaks from spectrogram frames pushed in time order.
+// A picker may hold frames back until enough of their neighbours have been
+// pushed; Flush emits the peaks still pending at the end of the input.
+// Peaks are emitted in time order.
+type PeakPicker interface {
+	Push(frame []float64, emit func(Peak))
+	Flush(emit func(Peak))
+}
+
+// NewPeakPicker returns the peak picker selected by cfg.
+func NewPeakPicker(cfg FingerprintConfig) (PeakPicker, error) {
+	switch cfg.PeakPicker {
+	case PeakPickerBand:
+		return &bandPicker{cfg: cfg}, nil
+	case PeakPickerConstellation:
+		return newConstellationPicker(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown peak picker %q", cfg.PeakPicker)
+	}
+}
+
+// bandPicker looks at one frame at a time and never holds frames back.
+type bandPicker struct {
+	cfg      FingerprintConfig
+	frameIdx int
+}
+
+func (p *bandPicker) Push(frame []float64, emit func(Peak)) {
+	for _, peak := range framePeaks(frame, p.frameIdx, p.cfg) {
+		emit(peak)
+	}
+	p.frameIdx++
+}
+
+func (p *bandPicker) Flush(emit func(Peak)) {}
+
+// framePeaks returns the peaks of a single spectrogram frame.
+func framePeaks(frame []float64, frameIdx int, cfg FingerprintConfig) []Peak {
+	type maxies struct {
+		maxMag  float64
+		freqIdx int
+	}
+
+	frameDuration := cfg.frameDuration()
+	freqResolution := cfg.freqResolution()
+
+	var maxMags []float64
+	var freqIndices []int
+
+	binBandMaxies := []maxies{}
+	for _, band := range cfg.PeakBands {
+		var maxx maxies
+		var maxMag float64
+		for idx, mag := range frame[band.Min:band.Max] {
+			if mag > maxMag {
+				maxMag = mag
+				freqIdx := band.Min + idx
+				maxx = maxies{mag, freqIdx}
+			}
+		}
+		binBandMaxies = append(binBandMaxies, maxx)
+	}
+
+	for _, value := range binBandMaxies {
+		maxMags = append(maxMags, value.maxMag)
+		freqIndices = append(freqIndices, value.freqIdx)
+	}
+
+	// Calculate the average magnitude
+	var maxMagsSum float64
+	for _, max := range maxMags {
+		maxMagsSum += max
+	}
+	avg := maxMagsSum / float64(len(maxMags))
+
+	// Add peaks that exceed the average magnitude
+	var peaks []Peak
+	for i, value := range maxMags {
+		if value > avg {
+			peakTime := float64(frameIdx) * frameDuration
+			peakFreq := float64(freqIndices[i]) * freqResolution
+
+			peaks = append(peaks, Peak{Time: peakTime, Freq: peakFreq})
+		}
+	}
+
+	return peaks
+}
+
+// constellationPicker keeps the bins that are the maximum of their
+// (2*TimeRadius+1) x (2*FreqRadius+1) neighbourhood and louder than the
+// amplitude floor. A frame is decided once TimeRadius later frames have
+// arrived, so frames are buffered in a ring of 2*TimeRadius+1 entries.
+// Only bins within the span of the configured peak bands are considered.
+type constellationPicker struct {
+	cfg    FingerprintConfig
+	params ConstellationConfig
+	lo, hi int
+
+	ring [][]float64
+	// pushed is the number of frames pushed; decided is the number of
+	// frames whose peaks have been emitted.
+	pushed, decided int
+}
+
+func newConstellationPicker(cfg FingerprintConfig) *constellationPicker {
+	lo, hi := cfg.PeakBands[0].Min, cfg.PeakBands[0].Max
+	for _, band := range cfg.PeakBands[1:] {
+		lo = min(lo, band.Min)
+		hi = max(hi, band.Max)
+	}
+
+	ring := make([][]float64, 2*cfg.Constellation.TimeRadius+1)
+	for i := range ring {
+		ring[i] = make([]float64, cfg.WindowSize/2)
+	}
+
+	return &constellationPicker{
+		cfg:    cfg,
+		params: cfg.Constellation,
+		lo:     lo,
+		hi:     hi,
+		ring:   ring,
+	}
+}
+
+func (p *constellationPicker) Push(frame []float64, emit func(Peak)) {
+	copy(p.ring[p.pushed%len(p.ring)], frame)
+	p.pushed++
+
+	if p.pushed-p.decided > p.params.TimeRadius {
+		p.decide(emit)
+	}
+}
+
+func (p *constellationPicker) Flush(emit func(Peak)) {
+	for p.decided < p.pushed {
+		p.decide(emit)
+	}
+}
+
+// decide emits the peaks of the oldest undecided frame, comparing it with
+// the neighbouring frames that exist.
+func (p *constellationPicker) decide(emit func(Peak)) {
+	t := p.decided
+	p.decided++
+
+	first := max(0, t-p.params.TimeRadius)
+	last := min(p.pushed-1, t+p.params.TimeRadius)
+	frame := p.ring[t%len(p.ring)]
+	peakTime := float64(t) * p.cfg.frameDuration()
+
+	for bin := p.lo; bin < p.hi; bin++ {
+		mag := frame[bin]
+		if mag <= p.params.MinMagnitude || !p.isLocalMax(t, bin, first, last) {
+			continue
+		}
+		emit(Peak{Time: peakTime, Freq: float64(bin) * p.cfg.freqResolution()})
+	}
+}
+
+// isLocalMax reports whether bin of frame t dominates its neighbourhood.
+// On a plateau only the earliest bin in time, then frequency, wins.
+func (p *constellationPicker) isLocalMax(t, bin, first, last int) bool {
+	mag := p.ring[t%len(p.ring)][bin]
+	lo := max(p.lo, bin-p.params.FreqRadius)
+	hi := min(p.hi-1, bin+p.params.FreqRadius)
+
+	// Check the peak's own frame first; it rejects most bins cheaply.
+	own := p.ring[t%len(p.ring)]
+	for b := lo; b <= hi; b++ {
+		if v := own[b]; v > mag || (v == mag && b < bin) {
+			return false
+		}
+	}
+
+	for i := first; i <= last; i++ {
+		if i == t {
+			continue
+		}
+		for _, v := range p.ring[i%len(p.ring)][lo : hi+1] {
+			if v > mag || (v == mag && i < t) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Peaks decodes filePath and returns its peaks as picked with cfg.
+func Peaks(filePath string, cfg FingerprintConfig) ([]Peak, error) {
+	reader, err := utils.OpenAudioWithOptions(filePath, cfg.Downmix)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding audio: %v", err)
+	}
+	defer reader.Close()
+
+	fp, err := NewStreamFingerprinter(reader.SampleRate(), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var peaks []Peak
+	fp.OnPeak = func(peak Peak) { peaks = append(peaks, peak) }
+	if err := fp.Consume(reader); err != nil {
+		return nil, err
+	}
+	return peaks, nil
+}
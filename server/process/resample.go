@@ -0,0 +1,163 @@
+package waveid
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	// resampleZeroCrossings is how many zero crossings of the sinc kernel
+	// are kept on each side of the interpolation point.
+	resampleZeroCrossings = 16
+	// resampleTableDensity is the number of kernel values stored per input
+	// sample; values in between are linearly interpolated.
+	resampleTableDensity = 256
+	// resampleRolloff places the cutoff slightly below the Nyquist
+	// frequency of the lower of the two rates to leave room for the
+	// transition band.
+	resampleRolloff = 0.95
+	// resampleKaiserBeta trades transition width for stopband attenuation
+	// (~80 dB at 8.0).
+	resampleKaiserBeta = 8.0
+)
+
+// Resample converts input from originalSampleRate to targetSampleRate with
+// a Kaiser-windowed sinc interpolator. Any ratio is supported, including
+// non-integer ones such as 48000 -> 11025, and the kernel's cutoff sits
+// below the lower Nyquist frequency so downsampling does not alias.
+func Resample(input []float64, originalSampleRate, targetSampleRate int) ([]float64, error) {
+	r, err := newResampler(originalSampleRate, targetSampleRate)
+	if err != nil {
+		return nil, err
+	}
+
+	resampled := make([]float64, 0, int(float64(len(input))/r.step)+1)
+	emit := func(y float64) { resampled = append(resampled, y) }
+	r.write(input, emit)
+	r.flush(emit)
+
+	return resampled, nil
+}
+
+// resampler is the streaming state behind Resample. Input samples are
+// appended to buf; output sample n is taken at input position n*step.
+type resampler struct {
+	step    float64
+	halfLen int
+	// table holds the kernel at x = i/resampleTableDensity input samples.
+	table []float64
+
+	buf []float64
+	// base is the absolute input index of buf[0].
+	base int
+	// n is the index of the next output sample.
+	n int
+	// end is the number of input samples once flushed, or -1 while open.
+	end int
+}
+
+func newResampler(originalSampleRate, targetSampleRate int) (*resampler, error) {
+	if targetSampleRate <= 0 || originalSampleRate <= 0 {
+		return nil, errors.New("sample rates must be positive")
+	}
+
+	step := float64(originalSampleRate) / float64(targetSampleRate)
+	cutoff := resampleRolloff * math.Min(1, 1/step)
+	halfLen := int(math.Ceil(resampleZeroCrossings / cutoff))
+
+	table := make([]float64, halfLen*resampleTableDensity+2)
+	i0Beta := besselI0(resampleKaiserBeta)
+	for i := range table {
+		x := float64(i) / resampleTableDensity
+		if x > float64(halfLen) {
+			break
+		}
+		ratio := x / float64(halfLen)
+		window := besselI0(resampleKaiserBeta*math.Sqrt(1-ratio*ratio)) / i0Beta
+		table[i] = cutoff * sinc(cutoff*x) * window
+	}
+
+	return &resampler{step: step, halfLen: halfLen, table: table, end: -1}, nil
+}
+
+// kernel evaluates the windowed sinc at distance x input samples.
+func (r *resampler) kernel(x float64) float64 {
+	pos := math.Abs(x) * resampleTableDensity
+	i := int(pos)
+	if i >= len(r.table)-1 {
+		return 0
+	}
+	frac := pos - float64(i)
+	return r.table[i] + frac*(r.table[i+1]-r.table[i])
+}
+
+func (r *resampler) write(input []float64, emit func(float64)) {
+	r.buf = append(r.buf, input...)
+	r.drain(emit)
+}
+
+// flush pads the input with silence so the last samples can be emitted.
+func (r *resampler) flush(emit func(float64)) {
+	r.end = r.base + len(r.buf)
+	r.buf = append(r.buf, make([]float64, r.halfLen)...)
+	r.drain(emit)
+}
+
+// drain emits every output sample whose kernel support is fully buffered
+// and drops input samples no later output needs.
+func (r *resampler) drain(emit func(float64)) {
+	available := r.base + len(r.buf)
+	for {
+		t := float64(r.n) * r.step
+		if r.end >= 0 && t >= float64(r.end) {
+			break
+		}
+		center := int(math.Floor(t))
+		if center+r.halfLen >= available {
+			break
+		}
+
+		var sum float64
+		for k := center - r.halfLen + 1; k <= center+r.halfLen; k++ {
+			idx := k - r.base
+			if idx < 0 {
+				continue // before the first sample
+			}
+			sum += r.buf[idx] * r.kernel(t-float64(k))
+		}
+		emit(sum)
+		r.n++
+	}
+
+	nextCenter := int(math.Floor(float64(r.n) * r.step))
+	if drop := nextCenter - r.halfLen + 1 - r.base; drop > 0 {
+		if drop > len(r.buf) {
+			drop = len(r.buf)
+		}
+		n := copy(r.buf, r.buf[drop:])
+		r.buf = r.buf[:n]
+		r.base += drop
+	}
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the zeroth-order modified Bessel function of the first kind,
+// evaluated by its power series.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	halfX := x / 2
+	for k := 1; k < 50; k++ {
+		term *= (halfX / float64(k)) * (halfX / float64(k))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
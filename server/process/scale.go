@@ -0,0 +1,167 @@
+package waveid
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"shazam/db"
+	"shazam/types"
+	"slices"
+	"time"
+)
+
+// How the pitch of a query relates to its speed in a scale search.
+const (
+	// PitchFollowsSpeed is playback at a different rate, as with a sped-up
+	// clip: pitch changes by the same factor as speed.
+	PitchFollowsSpeed = "follow"
+	// PitchKept is time stretching that preserves pitch.
+	PitchKept = "keep"
+	// PitchSearched searches pitch shifts independently of speed.
+	PitchSearched = "search"
+)
+
+// ScaleOptions controls the stretch factors FindMatchesScaled tries.
+type ScaleOptions struct {
+	// MaxChange is the largest relative change searched in either
+	// direction, e.g. 0.1 for speeds between 0.9 and 1.1.
+	MaxChange float64
+	// Step is the distance between two candidate factors.
+	Step float64
+	// Pitch is PitchFollowsSpeed, PitchKept or PitchSearched.
+	Pitch string
+}
+
+// DefaultScaleOptions searches speed-ups and slow-downs of up to 10% with
+// pitch following the speed.
+func DefaultScaleOptions() ScaleOptions {
+	return ScaleOptions{MaxChange: 0.1, Step: 0.01, Pitch: PitchFollowsSpeed}
+}
+
+// MaxScaleCandidates bounds the speed and pitch pairs one scale search may
+// try, as every pair costs a full lookup. Searching pitch independently of
+// speed squares the number of factors, so it needs a coarser step.
+const MaxScaleCandidates = 121
+
+// Validate reports options FindMatchesScaled rejects.
+func (o ScaleOptions) Validate() error {
+	if o.Pitch != PitchFollowsSpeed && o.Pitch != PitchKept && o.Pitch != PitchSearched {
+		return fmt.Errorf("unknown pitch mode %q", o.Pitch)
+	}
+	if n := len(o.candidates()); n > MaxScaleCandidates {
+		return fmt.Errorf("a change of up to %.2f in steps of %.3f with pitch mode %q tries %d speed and pitch pairs, more than %d; use a larger step",
+			o.MaxChange, o.Step, o.Pitch, n, MaxScaleCandidates)
+	}
+	return nil
+}
+
+// factors returns the candidate factors, nearest to 1 first.
+func (o ScaleOptions) factors() []float64 {
+	factors := []float64{1}
+	if o.Step <= 0 {
+		return factors
+	}
+	for i := 1; float64(i)*o.Step <= o.MaxChange+1e-9; i++ {
+		factors = append(factors, 1+float64(i)*o.Step, 1-float64(i)*o.Step)
+	}
+	return factors
+}
+
+// FindMatchesScaled matches query peaks that may be played faster or
+// slower, or pitch shifted, than the catalog songs. Each candidate pair of
+// speed and pitch factors maps the peaks back onto the song's time and
+// frequency grid before hashing, so the catalog itself needs no change.
+// The matches of the candidate with the best scoring song are returned,
+// with SpeedFactor and PitchFactor set.
+func FindMatchesScaled(store db.FingerprintStore, peaks []Peak, cfg FingerprintConfig, opts MatchOptions, scale ScaleOptions) ([]types.Match, time.Duration, error) {
+	startTime := time.Now()
+	if err := scale.Validate(); err != nil {
+		return nil, 0, err
+	}
+
+	var best []types.Match
+	for _, c := range scale.candidates() {
+		hashes := Extract(rescalePeaks(peaks, c.speed, c.pitch, cfg), cfg)
+		matches, _, err := FindMatchesFGP(store, hashes, cfg, opts)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(matches) == 0 || (len(best) > 0 && matches[0].Score <= best[0].Score*scaleMargin) {
+			continue
+		}
+		for i := range matches {
+			matches[i].SpeedFactor = c.speed
+			matches[i].PitchFactor = c.pitch
+		}
+		best = matches
+	}
+
+	return best, time.Since(startTime), nil
+}
+
+// scaleMargin is how much higher than the best so far a candidate further
+// from 1 must score. Sustained notes still collect hits under slightly
+// wrong factors, and unchanged audio should not be reported as stretched.
+const scaleMargin = 1.1
+
+type scaleCandidate struct {
+	speed, pitch float64
+}
+
+// candidates returns the speed and pitch pairs to try, smallest total
+// change first.
+func (o ScaleOptions) candidates() []scaleCandidate {
+	factors := o.factors()
+	var candidates []scaleCandidate
+	for _, speed := range factors {
+		switch o.Pitch {
+		case PitchFollowsSpeed:
+			candidates = append(candidates, scaleCandidate{speed, speed})
+		case PitchKept:
+			candidates = append(candidates, scaleCandidate{speed, 1})
+		case PitchSearched:
+			for _, pitch := range factors {
+				candidates = append(candidates, scaleCandidate{speed, pitch})
+			}
+		}
+	}
+
+	change := func(c scaleCandidate) float64 {
+		return math.Abs(c.speed-1) + math.Abs(c.pitch-1)
+	}
+	slices.SortStableFunc(candidates, func(a, b scaleCandidate) int {
+		return cmp.Compare(change(a), change(b))
+	})
+	return candidates
+}
+
+// rescalePeaks maps peaks of a query played speed times as fast, with its
+// frequencies multiplied by pitch, back to the original song's time and
+// frequency. Results are snapped to the frame and bin grid that song peaks
+// lie on, so they hash to the same addresses.
+func rescalePeaks(peaks []Peak, speed, pitch float64, cfg FingerprintConfig) []Peak {
+	if speed == 1 && pitch == 1 {
+		return peaks
+	}
+
+	frameDuration := cfg.frameDuration()
+	freqResolution := cfg.freqResolution()
+
+	scaled := make([]Peak, 0, len(peaks))
+	for _, peak := range peaks {
+		frame := math.Round(peak.Time * speed / frameDuration)
+		bin := math.Round(peak.Freq / pitch / freqResolution)
+		if bin >= float64(cfg.WindowSize/2) {
+			continue
+		}
+		scaled = append(scaled, Peak{Time: frame * frameDuration, Freq: bin * freqResolution})
+	}
+
+	// Slowing down can snap two peaks onto the same point. Sorting makes
+	// such duplicates adjacent even if peaks of one frame were not ordered
+	// by frequency.
+	slices.SortFunc(scaled, func(a, b Peak) int {
+		return cmp.Or(cmp.Compare(a.Time, b.Time), cmp.Compare(a.Freq, b.Freq))
+	})
+	return slices.Compact(scaled)
+}
@@ -0,0 +1,173 @@
+package waveid
+
+import (
+	"fmt"
+	"io"
+	"shazam/types"
+	"shazam/utils"
+)
+
+// streamBlockSize is how many input samples are processed at a time.
+const streamBlockSize = 4096
+
+// StreamFingerprinter runs the input filters, resample, STFT, peak and hash
+// stages incrementally. Samples are pushed with Write and results are
+// reported through OnPeak and OnHash as soon as they are final, so memory
+// use does not depend on the length of the input.
+type StreamFingerprinter struct {
+	// OnPeak, if set, is called for every peak in time order.
+	OnPeak func(Peak)
+	// OnHash, if set, is called for every anchor/target pair.
+	OnHash func(types.Hash)
+
+	cfg FingerprintConfig
+
+	// sampleRate is the input rate; written counts the input samples.
+	sampleRate int
+	written    int64
+
+	// input is cfg.PreFilter followed by the anti-aliasing filter.
+	input     Filter
+	resampler *resampler
+	stft      *stft
+	picker    PeakPicker
+
+	// filtered is scratch space for filtered input samples.
+	filtered []float64
+	// frame holds the resampled samples not yet consumed by the STFT.
+	frame     []float64
+	magnitude []float64
+
+	// anchors are the most recent peaks still waiting for targets.
+	anchors []Peak
+}
+
+func NewStreamFingerprinter(sampleRate int, cfg FingerprintConfig) (*StreamFingerprinter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	rs, err := newResampler(sampleRate, cfg.SampleRate)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resample audio sample: %v", err)
+	}
+	picker, err := NewPeakPicker(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamFingerprinter{
+		cfg:        cfg,
+		sampleRate: sampleRate,
+		input:      newInputFilter(sampleRate, cfg),
+		resampler:  rs,
+		stft:       newSTFT(cfg),
+		picker:     picker,
+		filtered:   make([]float64, 0, streamBlockSize),
+		frame:      make([]float64, 0, cfg.WindowSize),
+		magnitude:  make([]float64, cfg.WindowSize/2),
+		anchors:    make([]Peak, 0, cfg.TargetZoneSize),
+	}, nil
+}
+
+// Write feeds mono samples at the sample rate given to NewStreamFingerprinter.
+func (s *StreamFingerprinter) Write(samples []float64) {
+	s.written += int64(len(samples))
+	for len(samples) > 0 {
+		n := min(len(samples), streamBlockSize)
+		s.filtered = s.filtered[:0]
+		for _, x := range samples[:n] {
+			s.filtered = append(s.filtered, s.input.Next(x))
+		}
+		s.resampler.write(s.filtered, s.pushResampled)
+		samples = samples[n:]
+	}
+}
+
+// DurationMs is the length in milliseconds of the audio written so far.
+func (s *StreamFingerprinter) DurationMs() uint32 {
+	return uint32(s.written * 1000 / int64(s.sampleRate))
+}
+
+// Close flushes the samples still held by the resampler and the peak
+// picker. No further samples may be written afterwards.
+func (s *StreamFingerprinter) Close() {
+	s.resampler.flush(s.pushResampled)
+	s.picker.Flush(s.pushPeak)
+}
+
+// Consume writes every sample of reader and closes the fingerprinter.
+func (s *StreamFingerprinter) Consume(reader utils.SampleReader) error {
+	buf := make([]float64, streamBlockSize)
+	for {
+		n, err := reader.ReadSamples(buf)
+		s.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading samples: %v", err)
+		}
+	}
+	s.Close()
+
+	return nil
+}
+
+func (s *StreamFingerprinter) pushResampled(y float64) {
+	s.frame = append(s.frame, y)
+	if len(s.frame) < s.cfg.WindowSize {
+		return
+	}
+
+	s.stft.magnitudes(s.frame, s.magnitude)
+	s.picker.Push(s.magnitude, s.pushPeak)
+
+	// Slide the frame forward by one hop.
+	n := copy(s.frame, s.frame[s.cfg.HopSize:])
+	s.frame = s.frame[:n]
+}
+
+// pushPeak pairs the new peak as a target with each of the previous
+// TargetZoneSize peaks, exactly as Extract does for a complete peak list.
+func (s *StreamFingerprinter) pushPeak(peak Peak) {
+	if s.OnPeak != nil {
+		s.OnPeak(peak)
+	}
+
+	if s.OnHash != nil {
+		for _, anchor := range s.anchors {
+			s.OnHash(types.Hash{
+				Address:      createAddress(anchor, peak, s.cfg),
+				AnchorTimeMs: uint32(anchor.Time * 1000),
+			})
+		}
+	}
+
+	if len(s.anchors) == s.cfg.TargetZoneSize {
+		copy(s.anchors, s.anchors[1:])
+		s.anchors = s.anchors[:s.cfg.TargetZoneSize-1]
+	}
+	s.anchors = append(s.anchors, peak)
+}
+
+// FingerprintStream reads reader to the end and reports every hash to onHash.
+func FingerprintStream(reader utils.SampleReader, cfg FingerprintConfig, onHash func(types.Hash)) error {
+	fp, err := NewStreamFingerprinter(reader.SampleRate(), cfg)
+	if err != nil {
+		return err
+	}
+	fp.OnHash = onHash
+
+	return fp.Consume(reader)
+}
+
+// FingerprintReader fingerprints raw interleaved PCM read from r.
+func FingerprintReader(r io.Reader, format utils.PCMFormat, cfg FingerprintConfig, onHash func(types.Hash)) error {
+	reader, err := utils.NewPCMReader(r, format)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return FingerprintStream(reader, cfg, onHash)
+}
@@ -0,0 +1,132 @@
+package waveid
+
+import (
+	"errors"
+	"shazam/db"
+	"shazam/types"
+	"slices"
+)
+
+// TimelineOptions controls how Timeline slides its analysis window.
+type TimelineOptions struct {
+	// WindowMs is the length of every query window; HopMs is how far the
+	// window moves each step.
+	WindowMs uint32
+	HopMs    uint32
+	// OffsetToleranceMs is how far the song position may drift between two
+	// windows for them to count as the same continuous play.
+	OffsetToleranceMs uint32
+	// MaxGap is how many windows in a row may fail to match inside a
+	// segment, e.g. during a transition or a talk-over.
+	MaxGap int
+	// MinWindows drops segments supported by fewer matching windows.
+	MinWindows int
+
+	Match MatchOptions
+}
+
+// DefaultTimelineOptions returns the options used unless configured otherwise.
+func DefaultTimelineOptions() TimelineOptions {
+	return TimelineOptions{
+		WindowMs:          10000,
+		HopMs:             5000,
+		OffsetToleranceMs: 1000,
+		MaxGap:            1,
+		MinWindows:        1,
+		Match:             DefaultMatchOptions(),
+	}
+}
+
+// Timeline identifies every song in a long recording such as a DJ set. It
+// matches consecutive windows of the recording's hashes and merges windows
+// that agree on the song and on its position into segments.
+func Timeline(store db.FingerprintStore, hashes []types.Hash, cfg FingerprintConfig, opts TimelineOptions) ([]types.TimelineSegment, error) {
+	if opts.WindowMs == 0 || opts.HopMs == 0 {
+		return nil, errors.New("timeline window and hop must be positive")
+	}
+
+	sorted := slices.Clone(hashes)
+	slices.SortFunc(sorted, func(a, b types.Hash) int {
+		return int(a.AnchorTimeMs) - int(b.AnchorTimeMs)
+	})
+	var endMs uint32
+	if len(sorted) > 0 {
+		endMs = sorted[len(sorted)-1].AnchorTimeMs
+	}
+
+	var segments []types.TimelineSegment
+	// missed counts the windows since the last segment was extended.
+	missed := 0
+	lo, hi := 0, 0
+	window := make([]types.Hash, 0, len(sorted))
+
+	for start := uint32(0); start <= endMs; start += opts.HopMs {
+		end := start + opts.WindowMs
+		for lo < len(sorted) && sorted[lo].AnchorTimeMs < start {
+			lo++
+		}
+		for hi < len(sorted) && sorted[hi].AnchorTimeMs < end {
+			hi++
+		}
+
+		// Shift the window to start at zero, as a standalone query would.
+		window = window[:0]
+		for _, hash := range sorted[lo:hi] {
+			window = append(window, types.Hash{Address: hash.Address, AnchorTimeMs: hash.AnchorTimeMs - start})
+		}
+
+		var matches []types.Match
+		if len(window) > 0 {
+			var err error
+			matches, _, err = FindMatchesFGP(store, window, cfg, opts.Match)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(matches) == 0 {
+			missed++
+			continue
+		}
+
+		match := matches[0]
+		windowEnd := min(end, endMs)
+		if n := len(segments); n > 0 && missed <= opts.MaxGap && continues(segments[n-1], match, start, opts) {
+			last := &segments[n-1]
+			last.EndMs = windowEnd
+			last.Windows++
+			last.Confidence = max(last.Confidence, match.Confidence)
+		} else {
+			segments = append(segments, types.TimelineSegment{
+				StartMs:        start,
+				EndMs:          windowEnd,
+				SongID:         match.SongID,
+				SongTitle:      match.SongTitle,
+				SongArtist:     match.SongArtist,
+				YouTubeID:      match.YouTubeID,
+				SongPositionMs: match.Timestamp,
+				Confidence:     match.Confidence,
+				Windows:        1,
+			})
+		}
+		missed = 0
+	}
+
+	kept := segments[:0]
+	for _, segment := range segments {
+		if segment.Windows >= opts.MinWindows {
+			kept = append(kept, segment)
+		}
+	}
+	return kept, nil
+}
+
+// continues reports whether match, found in the window at start, carries on
+// segment: the same song, at the song position the segment predicts.
+func continues(segment types.TimelineSegment, match types.Match, start uint32, opts TimelineOptions) bool {
+	if match.SongID != segment.SongID {
+		return false
+	}
+	expected := int64(segment.SongPositionMs) + int64(start) - int64(segment.StartMs)
+	drift := int64(match.Timestamp) - expected
+	return max(drift, -drift) <= int64(opts.OffsetToleranceMs)
+}
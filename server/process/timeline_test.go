@@ -0,0 +1,157 @@
+package waveid
+
+import (
+	"fmt"
+	"shazam/db"
+	"shazam/types"
+	"testing"
+)
+
+// timelineSongMs is the length of every synthetic song; each one has a
+// hash of its own every timelineHashMs.
+const (
+	timelineSongMs = 120000
+	timelineHashMs = 100
+)
+
+// songAddress gives every hash of every synthetic song a distinct address.
+func songAddress(songID, songMs uint32) uint32 {
+	return songID<<16 | songMs/timelineHashMs
+}
+
+// piece plays the song from fromMs to toMs, song time, starting at atMs in
+// the recording.
+type piece struct {
+	songID       uint32
+	fromMs, toMs uint32
+	atMs         uint32
+}
+
+func recording(pieces ...piece) []types.Hash {
+	var hashes []types.Hash
+	for _, p := range pieces {
+		for t := p.fromMs; t < p.toMs; t += timelineHashMs {
+			hashes = append(hashes, types.Hash{Address: songAddress(p.songID, t), AnchorTimeMs: p.atMs + t - p.fromMs})
+		}
+	}
+	return hashes
+}
+
+// timelineStore returns a memory store holding songs 1 and 2.
+func timelineStore(t *testing.T, cfg FingerprintConfig) db.FingerprintStore {
+	store := db.MemoryClient(t.Name())
+	if err := CheckConfig(store, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, songID := range []uint32{1, 2} {
+		id, err := store.RegisterSong(types.Song{ID: songID, Title: fmt.Sprintf("Song %d", songID), Artist: "Artist"})
+		if err != nil || id != songID {
+			t.Fatalf("RegisterSong(%d) = %d, %v", songID, id, err)
+		}
+		if err := store.StoreFingerprints(songID, recording(piece{songID, 0, timelineSongMs, 0})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestTimeline(t *testing.T) {
+	type segment struct {
+		songID                uint32
+		startMs, endMs, posMs uint32
+		windows               int
+	}
+
+	tests := []struct {
+		name   string
+		pieces []piece
+		adjust func(*TimelineOptions)
+		want   []segment
+	}{
+		{
+			name: "song change",
+			pieces: []piece{
+				{songID: 1, fromMs: 10000, toMs: 40000, atMs: 0},
+				{songID: 2, fromMs: 20000, toMs: 50000, atMs: 35000},
+			},
+			want: []segment{{1, 0, 35000, 10000, 6}, {2, 30000, 64900, 15000, 7}},
+		},
+		{
+			name: "gap within MaxGap",
+			pieces: []piece{
+				{songID: 1, fromMs: 10000, toMs: 40000, atMs: 0},
+				{songID: 1, fromMs: 50000, toMs: 70000, atMs: 40000},
+			},
+			want: []segment{{1, 0, 59900, 10000, 11}},
+		},
+		{
+			name: "gap beyond MaxGap",
+			pieces: []piece{
+				{songID: 1, fromMs: 10000, toMs: 40000, atMs: 0},
+				{songID: 1, fromMs: 50000, toMs: 70000, atMs: 40000},
+			},
+			adjust: func(o *TimelineOptions) { o.MaxGap = 0 },
+			want:   []segment{{1, 0, 35000, 10000, 6}, {1, 35000, 59900, 45000, 5}},
+		},
+		{
+			name: "drift within tolerance",
+			pieces: []piece{
+				{songID: 1, fromMs: 10000, toMs: 40000, atMs: 0},
+				{songID: 1, fromMs: 40500, toMs: 70500, atMs: 30000},
+			},
+			want: []segment{{1, 0, 59900, 10000, 12}},
+		},
+		{
+			name: "drift beyond tolerance",
+			pieces: []piece{
+				{songID: 1, fromMs: 10000, toMs: 40000, atMs: 0},
+				{songID: 1, fromMs: 43000, toMs: 73000, atMs: 30000},
+			},
+			want: []segment{{1, 0, 35000, 10000, 6}, {1, 30000, 59900, 43000, 6}},
+		},
+		{
+			name: "short segment kept",
+			pieces: []piece{
+				{songID: 1, fromMs: 10000, toMs: 40000, atMs: 0},
+				{songID: 2, fromMs: 20000, toMs: 27000, atMs: 40000},
+			},
+			want: []segment{{1, 0, 35000, 10000, 6}, {2, 35000, 46900, 15000, 3}},
+		},
+		{
+			name: "short segment below MinWindows",
+			pieces: []piece{
+				{songID: 1, fromMs: 10000, toMs: 40000, atMs: 0},
+				{songID: 2, fromMs: 20000, toMs: 27000, atMs: 40000},
+			},
+			adjust: func(o *TimelineOptions) { o.MinWindows = 4 },
+			want:   []segment{{1, 0, 35000, 10000, 6}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			store := timelineStore(t, cfg)
+
+			opts := DefaultTimelineOptions()
+			// Every address occurs in one of the two songs, which the
+			// stop-hash ratio would count as common.
+			opts.Match = MatchOptions{Threshold: DefaultThreshold}
+			if test.adjust != nil {
+				test.adjust(&opts)
+			}
+
+			segments, err := Timeline(store, recording(test.pieces...), cfg, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []segment
+			for _, s := range segments {
+				got = append(got, segment{s.SongID, s.StartMs, s.EndMs, s.SongPositionMs, s.Windows})
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("segments = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
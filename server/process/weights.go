@@ -0,0 +1,67 @@
+package waveid
+
+import (
+	"math"
+	"shazam/types"
+)
+
+// minStopHashSongs is the fewest songs an address must occur in to be a
+// stop hash, so that small catalogs never lose their addresses.
+const minStopHashSongs = 10
+
+// addressWeights returns the weight of every address of sample, from the
+// number of the catalog's songs it occurs in. Stop hashes, addresses that
+// occur in more than opts.StopHashRatio of the songs, get weight 0 and are
+// not looked up at all. The rest weigh 1 unless opts.IDF is set, in which
+// case an address found in a single song weighs 1 and one found in every
+// song weighs close to 0. It returns nil when every address weighs 1.
+func addressWeights(postings PostingSource, sample []types.Hash, songs int, opts MatchOptions) (map[uint32]float64, error) {
+	if (opts.StopHashRatio <= 0 && !opts.IDF) || songs == 0 {
+		return nil, nil
+	}
+
+	addresses := make([]uint32, 0, len(sample))
+	weights := make(map[uint32]float64, len(sample))
+	for _, hash := range sample {
+		if _, ok := weights[hash.Address]; !ok {
+			addresses = append(addresses, hash.Address)
+			weights[hash.Address] = 1
+		}
+	}
+
+	frequencies, err := postings.DocumentFrequencies(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	n := float64(songs)
+	for address, df := range frequencies {
+		switch {
+		case opts.StopHashRatio > 0 && df >= minStopHashSongs && float64(df) > opts.StopHashRatio*n:
+			weights[address] = 0
+		case opts.IDF:
+			weights[address] = math.Log(1+n/float64(df)) / math.Log(1+n)
+		}
+	}
+	return weights, nil
+}
+
+// meanWeight is the mean weight of the hashes of sample that are not
+// skipped, the expected weight of a random hit. It is 1 when weights is nil.
+func meanWeight(sample []types.Hash, weights map[uint32]float64) float64 {
+	if weights == nil {
+		return 1
+	}
+	var sum float64
+	n := 0
+	for _, hash := range sample {
+		if w := weights[hash.Address]; w > 0 {
+			sum += w
+			n++
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return sum / float64(n)
+}
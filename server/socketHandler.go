@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"shazam/db"
 	waveid "shazam/process"
 	"shazam/types"
@@ -25,16 +27,10 @@ func downloadStatus(statusType, message string) string {
 	return string(jsonData)
 }
 
-func handleTotalSongs(socket socketio.Conn) {
+func handleTotalSongs(socket socketio.Conn, dbClient db.FingerprintStore) {
 	ctx := context.Background()
 
-	db, err := db.DBClient(DB_PATH)
-	if err != nil {
-		return
-	}
-	defer db.Close()
-
-	totalSongs, err := db.TotalSongs()
+	totalSongs, err := dbClient.TotalSongs()
 	if err != nil {
 		slog.ErrorContext(ctx, "Log error getting total songs", slog.Any("error", err))
 		return
@@ -43,46 +39,73 @@ func handleTotalSongs(socket socketio.Conn) {
 	socket.Emit("totalSongs", totalSongs)
 }
 
-// handleNewRecording saves new recorded audio snippet to a WAV file.
-func handleNewRecording(conn socketio.Conn, recordData string) {
-
+// handleNewRecording saves a recording the client chose to upload to the
+// recordings folder. Recordings are matched by the fingerprint the client
+// sends with newFingerprint, not by the upload.
+func handleNewRecording(socket socketio.Conn, recordData string) {
 	var recData types.RecordData
 	if err := json.Unmarshal([]byte(recordData), &recData); err != nil {
+		slog.Error("Failed to unmarshal recording", "error", err)
 		return
 	}
 
-	err := utils.CreateFolder("recordings")
+	audio, err := base64.StdEncoding.DecodeString(recData.Audio)
 	if err != nil {
+		slog.Error("Failed to decode recording", "error", err)
+		return
 	}
 
-	now := time.Now()
-	fileName := fmt.Sprintf("%04d_%02d_%02d_%02d_%02d_%02d.wav",
-		now.Second(), now.Minute(), now.Hour(),
-		now.Day(), now.Month(), now.Year(),
-	)
-	filePath := "recordings/" + fileName
+	saveRecording(audio)
+}
 
-	decodedAudioData, err := base64.StdEncoding.DecodeString(recData.Audio)
-	if err != nil {
+// saveRecording writes an uploaded WAV file to the recordings folder.
+func saveRecording(audio []byte) {
+	if err := utils.CreateFolder("recordings"); err != nil {
+		slog.Error("Failed to create recordings folder", "error", err)
+		return
 	}
 
-	err = utils.WriteWavFile(filePath, decodedAudioData, recData.SampleRate, recData.Channels, recData.SampleSize)
-	if err != nil {
+	now := time.Now()
+	fileName := fmt.Sprintf("%04d_%02d_%02d_%02d_%02d_%02d.wav",
+		now.Year(), now.Month(), now.Day(),
+		now.Hour(), now.Minute(), now.Second(),
+	)
+	if err := os.WriteFile(filepath.Join("recordings", fileName), audio, 0644); err != nil {
+		slog.Error("Failed to save recording", "error", err)
 	}
 }
 
-func handleNewFingerprint(socket socketio.Conn, fingerprintData string) {
+// handleNewFingerprint emits the matches for hashes computed by the client.
+// The hashes must come from the same fingerprint config as the catalog, so
+// a client that sends another config ID gets a matchError instead of an
+// empty result.
+func handleNewFingerprint(socket socketio.Conn, fingerprintData string, dbClient db.FingerprintStore, opts waveid.MatchOptions) {
 	var data struct {
-		Fingerprint map[uint32]uint32 `json:"fingerprint"`
+		ConfigID    string       `json:"configId"`
+		Fingerprint []types.Hash `json:"fingerprint"`
 	}
 	if err := json.Unmarshal([]byte(fingerprintData), &data); err != nil {
 		slog.Error("Failed to unmarshal fingerprint", "error", err)
 		return
 	}
+	if data.ConfigID != fpConfig.ID() {
+		slog.Warn("Rejected fingerprint from another config", "configId", data.ConfigID, "want", fpConfig.ID())
+		socket.Emit("matchError", fmt.Sprintf("fingerprint config %q does not match the server's config %s; the client's fingerprint.wasm must be rebuilt", data.ConfigID, fpConfig.ID()))
+		return
+	}
 
-	matches, _, err := waveid.FindMatchesFGP(data.Fingerprint)
+	emitMatches(socket, dbClient, data.Fingerprint, opts)
+}
+
+// emitMatches emits the matches that reach opts.Threshold, or null when no
+// song is a confident match. A failed lookup emits matchError instead, so
+// that it is not mistaken for a confident "no match".
+func emitMatches(socket socketio.Conn, dbClient db.FingerprintStore, fingerprint []types.Hash, opts waveid.MatchOptions) {
+	matches, _, err := waveid.FindMatchesFGP(dbClient, fingerprint, fpConfig, opts)
 	if err != nil {
 		slog.Error("Error finding matches", "error", err)
+		socket.Emit("matchError", "Failed to look up matches")
+		return
 	}
 
 	if len(matches) == 0 {
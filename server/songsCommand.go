@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"shazam/db"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const songsUsage = `Usage:
+  main.go songs list [-filter text] [-page 1] [-per-page 20]
+  main.go songs show <id>
+  main.go songs edit <id> [-title title] [-artist artist] [-youtube id] [-album album] [-year year]
+                          [-isrc code] [-genre genre] [-tag key=value ...]
+  main.go songs delete <id>`
+
+// manageSongs runs the songs subcommand given in args.
+func manageSongs(args []string) {
+	if len(args) < 1 {
+		fmt.Println(songsUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		listCmd := flag.NewFlagSet("songs list", flag.ExitOnError)
+		filter := listCmd.String("filter", "", "Only list songs whose title or artist contains this text")
+		page := listCmd.Int("page", 1, "Page to show")
+		perPage := listCmd.Int("per-page", 20, "Songs per page (0 lists all)")
+		listCmd.Parse(args[1:])
+		withStore(func(store db.FingerprintStore) error {
+			listSongs(store, *filter, max(*page, 1), max(*perPage, 0))
+			return nil
+		})
+	case "show":
+		songID, ok := songIDArg(args[1:])
+		if !ok {
+			fmt.Println(songsUsage)
+			os.Exit(1)
+		}
+		withStore(func(store db.FingerprintStore) error {
+			showSong(store, songID)
+			return nil
+		})
+	case "edit":
+		songID, ok := songIDArg(args[1:])
+		if !ok {
+			fmt.Println(songsUsage)
+			os.Exit(1)
+		}
+		editCmd := flag.NewFlagSet("songs edit", flag.ExitOnError)
+		title := editCmd.String("title", "", "New title")
+		artist := editCmd.String("artist", "", "New artist")
+		youtube := editCmd.String("youtube", "", "New YouTube video ID")
+		album := editCmd.String("album", "", "New album")
+		year := editCmd.Int("year", 0, "New release year")
+		isrc := editCmd.String("isrc", "", "New ISRC")
+		genre := editCmd.String("genre", "", "New genre")
+		tags := map[string]string{}
+		editCmd.Func("tag", "Set a tag as key=value, or remove it with key=; may be repeated", func(s string) error {
+			key, value, ok := strings.Cut(s, "=")
+			if !ok || key == "" {
+				return errors.New("expected key=value")
+			}
+			tags[key] = value
+			return nil
+		})
+		editCmd.Parse(args[2:])
+		change := songEdit{
+			title: *title, artist: *artist, youtube: *youtube,
+			album: *album, year: *year, isrc: *isrc, genre: *genre, tags: tags,
+		}
+		withStore(func(store db.FingerprintStore) error {
+			editSong(store, songID, change)
+			return nil
+		})
+	case "delete":
+		songID, ok := songIDArg(args[1:])
+		if !ok {
+			fmt.Println(songsUsage)
+			os.Exit(1)
+		}
+		withStore(func(store db.FingerprintStore) error {
+			deleteSong(store, songID)
+			return nil
+		})
+	default:
+		fmt.Println(songsUsage)
+		os.Exit(1)
+	}
+}
+
+// songIDArg parses the song ID at the start of args.
+func songIDArg(args []string) (uint32, bool) {
+	if len(args) < 1 {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		fmt.Printf("Invalid song ID %q\n", args[0])
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+func listSongs(dbClient db.FingerprintStore, filter string, page, perPage int) {
+	songs, total, err := dbClient.FindSongs(db.SongQuery{Text: filter, Limit: perPage, Offset: (page - 1) * perPage})
+	if err != nil {
+		fmt.Println("Error listing songs:", err)
+		return
+	}
+	if total == 0 {
+		fmt.Println("No songs found.")
+		return
+	}
+
+	pages := 1
+	if perPage > 0 {
+		pages = (total + perPage - 1) / perPage
+	}
+	fmt.Printf("%-10s  %-30s  %-30s  %s\n", "ID", "Artist", "Title", "YouTube ID")
+	for _, song := range songs {
+		fmt.Printf("%-10d  %-30s  %-30s  %s\n", song.ID, song.Artist, song.Title, song.YouTubeID)
+	}
+	fmt.Printf("\nPage %d of %d, %d songs\n", page, pages, total)
+}
+
+func showSong(dbClient db.FingerprintStore, songID uint32) {
+	song, ok, err := dbClient.GetSongByID(songID)
+	if err != nil {
+		fmt.Println("Error reading song:", err)
+		return
+	}
+	if !ok {
+		fmt.Printf("No song with ID %d\n", songID)
+		return
+	}
+	fingerprints, err := dbClient.SongFingerprintCount(songID)
+	if err != nil {
+		fmt.Println("Error counting fingerprints:", err)
+		return
+	}
+
+	source := song.Source
+	if source == "" {
+		source = "local file"
+		if song.YouTubeID != "" {
+			source = "https://www.youtube.com/watch?v=" + song.YouTubeID
+		}
+	}
+	fmt.Printf("ID:           %d\n", song.ID)
+	fmt.Printf("Title:        %s\n", song.Title)
+	fmt.Printf("Artist:       %s\n", song.Artist)
+	printField := func(label, value string) {
+		if value != "" {
+			fmt.Printf("%-13s %s\n", label+":", value)
+		}
+	}
+	printField("Album", song.Album)
+	if song.ReleaseYear != 0 {
+		printField("Year", strconv.Itoa(song.ReleaseYear))
+	}
+	printField("Genre", song.Genre)
+	printField("ISRC", song.ISRC)
+	if song.DurationMs != 0 {
+		printField("Duration", formatPosition(song.DurationMs))
+	}
+	fmt.Printf("Source:       %s\n", source)
+	if !song.IngestedAt.IsZero() {
+		printField("Ingested", song.IngestedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("Fingerprints: %d\n", fingerprints)
+	if len(song.Tags) > 0 {
+		fmt.Println("Tags:")
+		for _, key := range slices.Sorted(maps.Keys(song.Tags)) {
+			fmt.Printf("  %s: %s\n", key, song.Tags[key])
+		}
+	}
+}
+
+// songEdit holds the changes asked for by songs edit; empty fields are
+// left unchanged.
+type songEdit struct {
+	title, artist, youtube string
+	album, isrc, genre     string
+	year                   int
+	// tags are set, or removed if their value is empty.
+	tags map[string]string
+}
+
+func editSong(dbClient db.FingerprintStore, songID uint32, change songEdit) {
+	song, ok, err := dbClient.GetSongByID(songID)
+	if err != nil {
+		fmt.Println("Error reading song:", err)
+		return
+	}
+	if !ok {
+		fmt.Printf("No song with ID %d\n", songID)
+		return
+	}
+	if change.title == "" && change.artist == "" && change.youtube == "" && change.album == "" &&
+		change.year == 0 && change.isrc == "" && change.genre == "" && len(change.tags) == 0 {
+		fmt.Println("Nothing to change; pass -title, -artist, -youtube, -album, -year, -isrc, -genre or -tag.")
+		return
+	}
+
+	if change.title != "" {
+		song.Title = change.title
+	}
+	if change.artist != "" {
+		song.Artist = change.artist
+	}
+	if change.youtube != "" {
+		song.YouTubeID = change.youtube
+	}
+	if change.album != "" {
+		song.Album = change.album
+	}
+	if change.isrc != "" {
+		song.ISRC = change.isrc
+	}
+	if change.genre != "" {
+		song.Genre = change.genre
+	}
+	if change.year != 0 {
+		song.ReleaseYear = change.year
+	}
+	for key, value := range change.tags {
+		if value == "" {
+			delete(song.Tags, key)
+			continue
+		}
+		if song.Tags == nil {
+			song.Tags = map[string]string{}
+		}
+		song.Tags[key] = value
+	}
+	if err := dbClient.UpdateSong(song); err != nil {
+		if errors.Is(err, db.ErrSongExists) {
+			fmt.Printf("Another song is already called %s by %s\n", song.Title, song.Artist)
+			return
+		}
+		fmt.Println("Error updating song:", err)
+		return
+	}
+	fmt.Printf("Updated song %d: %s by %s\n", song.ID, song.Title, song.Artist)
+}
+
+func deleteSong(dbClient db.FingerprintStore, songID uint32) {
+	song, ok, err := dbClient.GetSongByID(songID)
+	if err != nil {
+		fmt.Println("Error reading song:", err)
+		return
+	}
+	if !ok {
+		fmt.Printf("No song with ID %d\n", songID)
+		return
+	}
+	if err := dbClient.DeleteSong(songID); err != nil {
+		fmt.Println("Error deleting song:", err)
+		return
+	}
+	fmt.Printf("Deleted song %d: %s by %s\n", song.ID, song.Title, song.Artist)
+}
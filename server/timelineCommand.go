@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"shazam/db"
+	waveid "shazam/process"
+	"shazam/types"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// timelineOnlyFlags are the find flags that apply only with -timeline, and
+// findOnlyFlags those that apply only without it.
+var (
+	timelineOnlyFlags = []string{"window", "hop", "format"}
+	findOnlyFlags     = []string{"speed", "speed-step", "pitch", "v"}
+)
+
+// checkTimelineFlags fails if a find flag set on the command line would be
+// ignored in the mode selected by timeline.
+func checkTimelineFlags(flags *flag.FlagSet, timeline bool) error {
+	ignored := findOnlyFlags
+	if !timeline {
+		ignored = timelineOnlyFlags
+	}
+
+	var set []string
+	flags.Visit(func(f *flag.Flag) {
+		if slices.Contains(ignored, f.Name) {
+			set = append(set, "-"+f.Name)
+		}
+	})
+	if len(set) == 0 {
+		return nil
+	}
+	if timeline {
+		return fmt.Errorf("%s cannot be combined with -timeline", strings.Join(set, ", "))
+	}
+	return fmt.Errorf("%s can only be used with -timeline", strings.Join(set, ", "))
+}
+
+// findTimeline identifies every song in a long recording and prints the
+// tracklist as text, json or csv.
+func findTimeline(dbClient db.FingerprintStore, filePath string, opts waveid.TimelineOptions, format string) {
+	if format != "text" && format != "json" && format != "csv" {
+		fmt.Printf("Unknown format %q, expected text, json or csv\n", format)
+		return
+	}
+
+	fingerprint, err := waveid.Fingerprint(filePath, fpConfig)
+	if err != nil {
+		fmt.Println("Error generating fingerprint for sample: ", err)
+		return
+	}
+
+	segments, err := waveid.Timeline(dbClient, fingerprint, fpConfig, opts)
+	if err != nil {
+		fmt.Println("Error building timeline:", err)
+		return
+	}
+
+	switch format {
+	case "json":
+		if segments == nil {
+			segments = []types.TimelineSegment{}
+		}
+		b, err := json.MarshalIndent(segments, "", "  ")
+		if err != nil {
+			fmt.Println("Error encoding timeline:", err)
+			return
+		}
+		fmt.Println(string(b))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"start_ms", "end_ms", "title", "artist", "song_id", "youtube_id", "song_position_ms", "confidence"})
+		for _, s := range segments {
+			w.Write([]string{
+				strconv.FormatUint(uint64(s.StartMs), 10),
+				strconv.FormatUint(uint64(s.EndMs), 10),
+				s.SongTitle,
+				s.SongArtist,
+				strconv.FormatUint(uint64(s.SongID), 10),
+				s.YouTubeID,
+				strconv.FormatUint(uint64(s.SongPositionMs), 10),
+				strconv.FormatFloat(s.Confidence, 'f', 3, 64),
+			})
+		}
+		w.Flush()
+	default:
+		if len(segments) == 0 {
+			fmt.Println("\nNo songs identified.")
+			return
+		}
+		fmt.Printf("\nTracklist (%d songs):\n", len(segments))
+		for i, s := range segments {
+			fmt.Printf("%3d. %s - %s  %s by %s (from %s, confidence: %.2f)\n",
+				i+1, formatPosition(s.StartMs), formatPosition(s.EndMs), s.SongTitle, s.SongArtist,
+				formatPosition(s.SongPositionMs), s.Confidence)
+		}
+	}
+}
@@ -1,11 +1,32 @@
 package types
 
+import (
+	"encoding/json"
+	"time"
+)
+
+// YTMeta is the part of the JSON printed by yt-dlp that is kept for a song.
 type YTMeta struct {
-	ID       string `json:"id"`
-	Title    string `json:"title"`
-	Artist   string `json:"artist"`
-	Uploader string `json:"uploader"`
-	Filename string `json:"filename"`
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Artist      string  `json:"artist"`
+	Uploader    string  `json:"uploader"`
+	Filename    string  `json:"filename"`
+	Album       string  `json:"album"`
+	Track       string  `json:"track"`
+	Genre       string  `json:"genre"`
+	ReleaseYear int     `json:"release_year"`
+	UploadDate  string  `json:"upload_date"`
+	Duration    float64 `json:"duration"`
+	WebpageURL  string  `json:"webpage_url"`
+	Channel     string  `json:"channel"`
+}
+
+// Hash is one fingerprint hash: the address of an anchor/target peak pair
+// and the time of the anchor. An address may occur at many anchor times.
+type Hash struct {
+	Address      uint32 `json:"address"`
+	AnchorTimeMs uint32 `json:"anchorTime"`
 }
 
 type Couple struct {
@@ -21,11 +42,13 @@ type RecordData struct {
 	SampleSize int     `json:"sampleSize"`
 }
 
+// WavInfo holds decoded audio. LeftChannelSamples contains the mono
+// downmix of the channels; Channels and BitsPerSample describe the source.
 type WavInfo struct {
 	Channels           int
 	SampleRate         int
+	BitsPerSample      int
 	LeftChannelSamples []float64
-	Data               []byte
 	Duration           float64
 }
 
@@ -51,8 +74,59 @@ type Match struct {
 	SongTitle  string
 	SongArtist string
 	YouTubeID  string
-	Timestamp  uint32
-	Score      float64
+	SongMetadata
+	// Timestamp is where in the song, in milliseconds, the query starts.
+	Timestamp uint32
+	Score     float64
+	// Confidence is between 0 and 1; see waveid.MatchOptions.
+	Confidence float64
+	// SpeedFactor is how many times as fast as the song the query plays,
+	// and PitchFactor how much its frequencies are shifted; both are 1
+	// unless found by a scale search.
+	SpeedFactor float64
+	PitchFactor float64
+
+	// HashHits is the number of query and song hash pairs that share an
+	// address, at any offset. QueryHashes is the size of the query, and
+	// SkippedHashes how many of its hashes were skipped as stop hashes.
+	HashHits      int
+	QueryHashes   int
+	SkippedHashes int
+	// BestBinCount is the number of hits in the winning offset bin, whose
+	// weight is the Score; RunnerUpBinCount is the best bin apart from it.
+	BestBinCount     int
+	RunnerUpBinCount int
+	// MatchedSpanMs is how much of the song the winning bin's hits span.
+	MatchedSpanMs uint32
+	// Coverage is the fraction of query hashes with a hit in the winning bin.
+	Coverage float64
+}
+
+// MarshalJSON encodes m without the song's Source, which for indexed files
+// is a path on the server that clients have no business seeing.
+func (m Match) MarshalJSON() ([]byte, error) {
+	type match Match
+	return json.Marshal(struct {
+		match
+		// Source shadows SongMetadata.Source; being nil, it is left out.
+		Source *string `json:",omitempty"`
+	}{match: match(m)})
+}
+
+// TimelineSegment is one song identified in a long recording. StartMs and
+// EndMs are positions in the recording; SongPositionMs is where in the song
+// the segment starts.
+type TimelineSegment struct {
+	StartMs        uint32  `json:"startMs"`
+	EndMs          uint32  `json:"endMs"`
+	SongID         uint32  `json:"songId"`
+	SongTitle      string  `json:"title"`
+	SongArtist     string  `json:"artist"`
+	YouTubeID      string  `json:"youtubeId"`
+	SongPositionMs uint32  `json:"songPositionMs"`
+	Confidence     float64 `json:"confidence"`
+	// Windows is the number of analysis windows that matched.
+	Windows int `json:"windows"`
 }
 
 type Song struct {
@@ -60,4 +134,21 @@ type Song struct {
 	Title     string
 	Artist    string
 	YouTubeID string
+	SongMetadata
+}
+
+// SongMetadata is what is known about a song besides its title and artist.
+// Every field is optional.
+type SongMetadata struct {
+	Album       string
+	DurationMs  uint32
+	ReleaseYear int
+	ISRC        string
+	Genre       string
+	// Source is the URL or file path the song was ingested from.
+	Source string
+	// IngestedAt is when the song was added to the catalog.
+	IngestedAt time.Time
+	// Tags holds any other metadata by name.
+	Tags map[string]string
 }
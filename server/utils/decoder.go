@@ -0,0 +1,450 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/jfreymuth/oggvorbis"
+	"github.com/mewkiz/flac"
+)
+
+const (
+	// decodeBlockFrames is how many frames the decoders convert at a time.
+	decodeBlockFrames = 4096
+	// ffmpegSampleRate is the rate the ffmpeg fallback resamples to.
+	ffmpegSampleRate = 44100
+)
+
+// SampleReader streams audio as mono float samples in [-1, 1].
+type SampleReader interface {
+	// SampleRate is the rate of the samples returned by ReadSamples.
+	SampleRate() int
+	// Channels is the channel count of the source before the downmix.
+	Channels() int
+	// ReadSamples fills dst and returns the number of samples written. It
+	// returns io.EOF once the stream is exhausted.
+	ReadSamples(dst []float64) (int, error)
+	Close() error
+}
+
+// AudioDecoder opens files of one audio format as a SampleReader that folds
+// the channels to mono as described by opts.
+type AudioDecoder interface {
+	Name() string
+	Extensions() []string
+	Open(path string, opts WavOptions) (SampleReader, error)
+}
+
+// decoders are tried by file extension before falling back to ffmpeg.
+var decoders = []AudioDecoder{
+	wavDecoder{},
+	mp3Decoder{},
+	flacDecoder{},
+	vorbisDecoder{},
+}
+
+// FallbackDecoder handles every extension without a native decoder.
+var FallbackDecoder AudioDecoder = ffmpegDecoder{}
+
+// DecoderFor returns the decoder used for path.
+func DecoderFor(path string) AudioDecoder {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, d := range decoders {
+		for _, e := range d.Extensions() {
+			if e == ext {
+				return d
+			}
+		}
+	}
+	return FallbackDecoder
+}
+
+// OpenAudioWithOptions opens path with the matching native decoder, or
+// ffmpeg when there is none, folding the channels to mono as described by
+// opts. WAV encodings the native decoder rejects as unsupported are retried
+// through ffmpeg as well.
+func OpenAudioWithOptions(path string, opts WavOptions) (SampleReader, error) {
+	decoder := DecoderFor(path)
+	reader, err := decoder.Open(path, opts)
+	if errors.Is(err, ErrUnsupportedFormat) && decoder != FallbackDecoder {
+		return FallbackDecoder.Open(path, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s decoder: %w", decoder.Name(), err)
+	}
+	return reader, nil
+}
+
+// readAllSamples reads reader to the end.
+func readAllSamples(reader SampleReader) ([]float64, error) {
+	var samples []float64
+	buf := make([]float64, decodeBlockFrames)
+	for {
+		n, err := reader.ReadSamples(buf)
+		samples = append(samples, buf[:n]...)
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// blockReader adapts a function that decodes one block of mono samples at a
+// time to the SampleReader interface.
+type blockReader struct {
+	sampleRate int
+	channels   int
+	next       func() ([]float64, error)
+	close      func() error
+	pending    []float64
+	err        error
+}
+
+func (b *blockReader) SampleRate() int { return b.sampleRate }
+func (b *blockReader) Channels() int   { return b.channels }
+func (b *blockReader) Close() error    { return b.close() }
+
+func (b *blockReader) ReadSamples(dst []float64) (int, error) {
+	n := 0
+	for n < len(dst) {
+		if len(b.pending) == 0 {
+			if b.err != nil {
+				break
+			}
+			b.pending, b.err = b.next()
+			continue
+		}
+		c := copy(dst[n:], b.pending)
+		b.pending = b.pending[c:]
+		n += c
+	}
+	if n == len(dst) || b.err == nil {
+		return n, nil
+	}
+	return n, b.err
+}
+
+type wavDecoder struct{}
+
+func (wavDecoder) Name() string         { return "wav" }
+func (wavDecoder) Extensions() []string { return []string{".wav", ".wave"} }
+
+func (wavDecoder) Open(path string, opts WavOptions) (SampleReader, error) {
+	reader, _, err := openWav(path, opts)
+	return reader, err
+}
+
+// openWav opens the WAV file at path and returns a reader of its samples
+// along with its format.
+func openWav(path string, opts WavOptions) (SampleReader, wavFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, wavFormat{}, err
+	}
+
+	r := &countingReader{r: bufio.NewReader(f)}
+	format, dataSize, err := readWavHeader(r)
+	if err != nil {
+		f.Close()
+		return nil, wavFormat{}, err
+	}
+	channel, err := opts.channel(format.channels)
+	if err != nil {
+		f.Close()
+		return nil, wavFormat{}, err
+	}
+
+	size := dataChunkSize(dataSize)
+
+	return newPCMReader(r, format, size, r.n-8, channel, f.Close), format, nil
+}
+
+// PCMFormat describes raw interleaved little-endian PCM.
+type PCMFormat struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	// Float selects IEEE float samples instead of signed integers.
+	Float bool
+}
+
+// NewPCMReader reads raw PCM from r until EOF, averaging the channels.
+func NewPCMReader(r io.Reader, format PCMFormat) (SampleReader, error) {
+	f := wavFormat{
+		formatTag:     wavFormatPCM,
+		channels:      format.Channels,
+		sampleRate:    format.SampleRate,
+		blockAlign:    format.Channels * format.BitsPerSample / 8,
+		bitsPerSample: format.BitsPerSample,
+	}
+	if format.Float {
+		f.formatTag = wavFormatIEEEFloat
+	}
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	return newPCMReader(r, f, -1, 0, -1, func() error { return nil }), nil
+}
+
+// newPCMReader decodes size bytes of PCM, or everything up to EOF when size
+// is negative, keeping only channel unless it is negative. dataStart is only
+// used for error reporting.
+func newPCMReader(r io.Reader, format wavFormat, size, dataStart int64, channel int, closeFn func() error) SampleReader {
+	unknownLength := size < 0
+	remaining := size
+	if unknownLength {
+		remaining = math.MaxInt64
+	}
+	raw := make([]byte, decodeBlockFrames*format.blockAlign)
+	out := make([]float64, decodeBlockFrames)
+
+	next := func() ([]float64, error) {
+		if remaining <= 0 {
+			return nil, io.EOF
+		}
+		want := int64(len(raw))
+		if remaining < want {
+			want = remaining
+		}
+		n, err := io.ReadFull(r, raw[:want])
+		remaining -= int64(n)
+		frames := n / format.blockAlign
+		for i := 0; i < frames; i++ {
+			out[i] = format.downmix(raw[i*format.blockAlign:(i+1)*format.blockAlign], channel)
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			if unknownLength {
+				remaining = 0
+				return out[:frames], nil
+			}
+			return out[:frames], &WavError{Chunk: "data", Offset: dataStart, Err: ErrTruncated,
+				Detail: fmt.Sprintf("%d bytes missing", remaining)}
+		}
+		return out[:frames], err
+	}
+
+	return &blockReader{sampleRate: format.sampleRate, channels: format.channels, next: next, close: closeFn}
+}
+
+type mp3Decoder struct{}
+
+func (mp3Decoder) Name() string         { return "mp3" }
+func (mp3Decoder) Extensions() []string { return []string{".mp3"} }
+
+func (mp3Decoder) Open(path string, opts WavOptions) (SampleReader, error) {
+	// go-mp3 always produces interleaved 16-bit little-endian stereo.
+	channel, err := opts.channel(2)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := mp3.NewDecoder(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	raw := make([]byte, decodeBlockFrames*4)
+	out := make([]float64, decodeBlockFrames)
+	next := func() ([]float64, error) {
+		n, err := io.ReadFull(d, raw)
+		frames := n / 4
+		for i := 0; i < frames; i++ {
+			l := int16(binary.LittleEndian.Uint16(raw[i*4:]))
+			r := int16(binary.LittleEndian.Uint16(raw[i*4+2:]))
+			switch channel {
+			case 0:
+				out[i] = float64(l) / 32768.0
+			case 1:
+				out[i] = float64(r) / 32768.0
+			default:
+				out[i] = (float64(l) + float64(r)) / 65536.0
+			}
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return out[:frames], err
+	}
+
+	return &blockReader{sampleRate: d.SampleRate(), channels: 2, next: next, close: f.Close}, nil
+}
+
+type flacDecoder struct{}
+
+func (flacDecoder) Name() string         { return "flac" }
+func (flacDecoder) Extensions() []string { return []string{".flac"} }
+
+func (flacDecoder) Open(path string, opts WavOptions) (SampleReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := flac.New(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	channels := int(stream.Info.NChannels)
+	channel, err := opts.channel(channels)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	scale := float64(int64(1) << (stream.Info.BitsPerSample - 1))
+	var out []float64
+	next := func() ([]float64, error) {
+		frame, err := stream.ParseNext()
+		if err != nil {
+			return nil, err
+		}
+		n := len(frame.Subframes[0].Samples)
+		if cap(out) < n {
+			out = make([]float64, n)
+		}
+		out = out[:n]
+		if channel >= 0 {
+			for i, sample := range frame.Subframes[channel].Samples {
+				out[i] = float64(sample) / scale
+			}
+			return out, nil
+		}
+		for i := range out {
+			var sum float64
+			for _, sub := range frame.Subframes {
+				sum += float64(sub.Samples[i])
+			}
+			out[i] = sum / float64(len(frame.Subframes)) / scale
+		}
+		return out, nil
+	}
+
+	return &blockReader{sampleRate: int(stream.Info.SampleRate), channels: channels, next: next, close: f.Close}, nil
+}
+
+type vorbisDecoder struct{}
+
+func (vorbisDecoder) Name() string         { return "vorbis" }
+func (vorbisDecoder) Extensions() []string { return []string{".ogg", ".oga"} }
+
+func (vorbisDecoder) Open(path string, opts WavOptions) (SampleReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := oggvorbis.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		// Ogg may also carry Opus or FLAC, which ffmpeg can handle.
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+
+	channels := r.Channels()
+	channel, err := opts.channel(channels)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	raw := make([]float32, decodeBlockFrames*channels)
+	out := make([]float64, decodeBlockFrames)
+	next := func() ([]float64, error) {
+		n, err := r.Read(raw)
+		frames := n / channels
+		for i := 0; i < frames; i++ {
+			if channel >= 0 {
+				out[i] = float64(raw[i*channels+channel])
+				continue
+			}
+			var sum float64
+			for c := 0; c < channels; c++ {
+				sum += float64(raw[i*channels+c])
+			}
+			out[i] = sum / float64(channels)
+		}
+		return out[:frames], err
+	}
+
+	return &blockReader{sampleRate: r.SampleRate(), channels: channels, next: next, close: f.Close}, nil
+}
+
+// ffmpegDecoder pipes any format ffmpeg understands as mono 16-bit PCM. A
+// kept channel is picked by ffmpeg, which fails if the input lacks it.
+type ffmpegDecoder struct{}
+
+func (ffmpegDecoder) Name() string         { return "ffmpeg" }
+func (ffmpegDecoder) Extensions() []string { return nil }
+
+func (ffmpegDecoder) Open(path string, opts WavOptions) (SampleReader, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	args := []string{"-v", "error", "-i", path}
+	if opts.Downmix == DownmixChannel {
+		args = append(args, "-af", fmt.Sprintf("pan=mono|c0=c%d", opts.Channel))
+	}
+	args = append(args,
+		"-f", "s16le",
+		"-acodec", "pcm_s16le",
+		"-ar", fmt.Sprint(ffmpegSampleRate),
+		"-ac", "1",
+		"-",
+	)
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+
+	pcm := bufio.NewReader(stdout)
+	raw := make([]byte, decodeBlockFrames*2)
+	out := make([]float64, decodeBlockFrames)
+	next := func() ([]float64, error) {
+		n, err := io.ReadFull(pcm, raw)
+		frames := n / 2
+		for i := 0; i < frames; i++ {
+			out[i] = float64(int16(binary.LittleEndian.Uint16(raw[i*2:]))) / 32768.0
+		}
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			if werr := cmd.Wait(); werr != nil {
+				return out[:frames], fmt.Errorf("ffmpeg failed: %v, output %v", werr, stderr.String())
+			}
+			err = io.EOF
+		}
+		return out[:frames], err
+	}
+	closeFn := func() error {
+		if cmd.ProcessState == nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		return nil
+	}
+
+	return &blockReader{sampleRate: ffmpegSampleRate, channels: 1, next: next, close: closeFn}, nil
+}
@@ -0,0 +1,332 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"shazam/types"
+)
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatIEEEFloat  = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+var (
+	ErrNotWav            = errors.New("not a RIFF/WAVE file")
+	ErrTruncated         = errors.New("truncated wav data")
+	ErrMalformedChunk    = errors.New("malformed wav chunk")
+	ErrMissingChunk      = errors.New("missing wav chunk")
+	ErrUnsupportedFormat = errors.New("unsupported wav format")
+)
+
+// WavError describes a problem found while parsing a WAV file. Err is one of
+// the Err* sentinels above, so callers can test for it with errors.Is.
+type WavError struct {
+	Chunk  string
+	Offset int64
+	Err    error
+	Detail string
+}
+
+func (e *WavError) Error() string {
+	msg := fmt.Sprintf("wav %q chunk at offset %d: %v", e.Chunk, e.Offset, e.Err)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *WavError) Unwrap() error {
+	return e.Err
+}
+
+// maxFmtChunkSize bounds the fmt chunk, which is at most 40 bytes for every
+// format this package reads, so a corrupt size cannot force a huge
+// allocation.
+const maxFmtChunkSize = 1024
+
+// Downmix selects how multichannel audio is folded into a single channel.
+type Downmix string
+
+const (
+	// DownmixAverage averages all channels of a frame. It is also used when
+	// no mode is set.
+	DownmixAverage Downmix = "average"
+	// DownmixChannel keeps only WavOptions.Channel and drops the others.
+	DownmixChannel Downmix = "channel"
+)
+
+// WavOptions controls how every decoder folds its input to mono.
+type WavOptions struct {
+	Downmix Downmix `json:"mode,omitempty"`
+	// Channel is the channel kept by DownmixChannel, counting from 0. Mono
+	// input is always used as it is.
+	Channel int `json:"channel,omitempty"`
+}
+
+// ReadWavInfo decodes a WAV file and averages all of its channels to mono.
+func ReadWavInfo(filename string) (*types.WavInfo, error) {
+	return ReadWavInfoWithOptions(filename, WavOptions{})
+}
+
+// ReadWavInfoWithOptions decodes 8/16/24/32-bit integer PCM and 32/64-bit IEEE
+// float WAV files, including WAVE_FORMAT_EXTENSIBLE headers, and folds the
+// channels to mono as described by opts. It reads the file through the same
+// decoder as OpenAudioWithOptions, but into memory.
+func ReadWavInfoWithOptions(filename string, opts WavOptions) (*types.WavInfo, error) {
+	reader, format, err := openWav(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	samples, err := readAllSamples(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.WavInfo{
+		Channels:           format.channels,
+		SampleRate:         format.sampleRate,
+		BitsPerSample:      format.bitsPerSample,
+		LeftChannelSamples: samples,
+		Duration:           float64(len(samples)) / float64(format.sampleRate),
+	}, nil
+}
+
+// wavFormat is the decoded content of a fmt chunk.
+type wavFormat struct {
+	formatTag     uint16
+	channels      int
+	sampleRate    int
+	blockAlign    int
+	bitsPerSample int
+}
+
+// dataChunkSize returns the data chunk size, or -1 when a streaming writer
+// left it unset and the samples run until EOF.
+func dataChunkSize(dataSize uint32) int64 {
+	if dataSize == 0 || dataSize == math.MaxUint32 {
+		return -1
+	}
+	return int64(dataSize)
+}
+
+// Validate checks the options independently of any input.
+func (opts WavOptions) Validate() error {
+	switch opts.Downmix {
+	case "", DownmixAverage:
+		return nil
+	case DownmixChannel:
+		if opts.Channel < 0 {
+			return fmt.Errorf("downmix channel %d is negative", opts.Channel)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown downmix mode %q", opts.Downmix)
+	}
+}
+
+// channel returns the channel to keep from input with the given number of
+// channels, or -1 to average them all.
+func (opts WavOptions) channel(channels int) (int, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+	if opts.Downmix != DownmixChannel || channels == 1 {
+		return -1, nil
+	}
+	if opts.Channel >= channels {
+		return 0, fmt.Errorf("downmix channel %d out of range for %d channels", opts.Channel, channels)
+	}
+	return opts.Channel, nil
+}
+
+// readWavHeader reads the RIFF header and every chunk up to the data chunk.
+// On success r is positioned at the first sample and the data chunk size is
+// returned.
+func readWavHeader(r *countingReader) (wavFormat, uint32, error) {
+	var riff struct {
+		ID     [4]byte
+		Size   uint32
+		Format [4]byte
+	}
+	if err := binary.Read(r, binary.LittleEndian, &riff); err != nil {
+		return wavFormat{}, 0, &WavError{Chunk: "RIFF", Err: ErrNotWav, Detail: err.Error()}
+	}
+	if string(riff.ID[:]) != "RIFF" || string(riff.Format[:]) != "WAVE" {
+		return wavFormat{}, 0, &WavError{Chunk: "RIFF", Err: ErrNotWav}
+	}
+
+	var format wavFormat
+	var fmtFound bool
+
+	for {
+		chunkStart := r.n
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			if errors.Is(err, io.EOF) {
+				missing := "data"
+				if !fmtFound {
+					missing = "fmt "
+				}
+				return wavFormat{}, 0, &WavError{Chunk: missing, Offset: chunkStart, Err: ErrMissingChunk}
+			}
+			return wavFormat{}, 0, &WavError{Chunk: "?", Offset: chunkStart, Err: ErrTruncated, Detail: err.Error()}
+		}
+		id := string(chunk.ID[:])
+
+		switch id {
+		case "fmt ":
+			if chunk.Size > maxFmtChunkSize {
+				return wavFormat{}, 0, &WavError{Chunk: id, Offset: chunkStart, Err: ErrMalformedChunk,
+					Detail: fmt.Sprintf("size %d is larger than %d", chunk.Size, maxFmtChunkSize)}
+			}
+			body := make([]byte, chunk.Size)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return wavFormat{}, 0, &WavError{Chunk: id, Offset: chunkStart, Err: ErrTruncated, Detail: err.Error()}
+			}
+			f, err := parseFmtChunk(body)
+			if err != nil {
+				var wavErr *WavError
+				if errors.As(err, &wavErr) {
+					wavErr.Offset = chunkStart
+				}
+				return wavFormat{}, 0, err
+			}
+			format = f
+			fmtFound = true
+
+		case "data":
+			if !fmtFound {
+				return wavFormat{}, 0, &WavError{Chunk: "fmt ", Offset: chunkStart, Err: ErrMissingChunk,
+					Detail: "data chunk appears before fmt chunk"}
+			}
+			return format, chunk.Size, nil
+
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(chunk.Size)); err != nil {
+				return wavFormat{}, 0, &WavError{Chunk: id, Offset: chunkStart, Err: ErrTruncated, Detail: err.Error()}
+			}
+		}
+
+		// Chunks are word aligned.
+		if chunk.Size%2 == 1 {
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil && !errors.Is(err, io.EOF) {
+				return wavFormat{}, 0, err
+			}
+		}
+	}
+}
+
+func parseFmtChunk(body []byte) (wavFormat, error) {
+	if len(body) < 16 {
+		return wavFormat{}, &WavError{Chunk: "fmt ", Err: ErrMalformedChunk,
+			Detail: fmt.Sprintf("size %d is smaller than 16", len(body))}
+	}
+
+	le := binary.LittleEndian
+	f := wavFormat{
+		formatTag:     le.Uint16(body[0:2]),
+		channels:      int(le.Uint16(body[2:4])),
+		sampleRate:    int(le.Uint32(body[4:8])),
+		blockAlign:    int(le.Uint16(body[12:14])),
+		bitsPerSample: int(le.Uint16(body[14:16])),
+	}
+
+	if f.formatTag == wavFormatExtensible {
+		// cbSize(2) validBits(2) channelMask(4) subFormat GUID(16); the
+		// first two bytes of the GUID hold the actual format tag.
+		if len(body) < 40 {
+			return wavFormat{}, &WavError{Chunk: "fmt ", Err: ErrMalformedChunk,
+				Detail: "extensible format without sub-format"}
+		}
+		f.formatTag = le.Uint16(body[24:26])
+	}
+
+	if err := f.validate(); err != nil {
+		return wavFormat{}, err
+	}
+	return f, nil
+}
+
+func (f wavFormat) validate() error {
+	if f.channels <= 0 || f.sampleRate <= 0 {
+		return &WavError{Chunk: "fmt ", Err: ErrMalformedChunk,
+			Detail: fmt.Sprintf("channels=%d sampleRate=%d", f.channels, f.sampleRate)}
+	}
+
+	switch {
+	case f.formatTag == wavFormatPCM && (f.bitsPerSample == 8 || f.bitsPerSample == 16 ||
+		f.bitsPerSample == 24 || f.bitsPerSample == 32):
+	case f.formatTag == wavFormatIEEEFloat && (f.bitsPerSample == 32 || f.bitsPerSample == 64):
+	default:
+		return &WavError{Chunk: "fmt ", Err: ErrUnsupportedFormat,
+			Detail: fmt.Sprintf("format tag 0x%04x with %d bits per sample", f.formatTag, f.bitsPerSample)}
+	}
+
+	if f.blockAlign != f.channels*f.bitsPerSample/8 {
+		return &WavError{Chunk: "fmt ", Err: ErrMalformedChunk,
+			Detail: fmt.Sprintf("block align %d does not match %d channels of %d bits", f.blockAlign, f.channels, f.bitsPerSample)}
+	}
+
+	return nil
+}
+
+// downmix converts one interleaved frame to a single sample in [-1, 1],
+// keeping only channel unless it is negative.
+func (f wavFormat) downmix(frame []byte, channel int) float64 {
+	width := f.bitsPerSample / 8
+	if channel >= 0 {
+		return f.sample(frame[channel*width : (channel+1)*width])
+	}
+
+	var sum float64
+	for c := 0; c < f.channels; c++ {
+		sum += f.sample(frame[c*width : (c+1)*width])
+	}
+	return sum / float64(f.channels)
+}
+
+// sample decodes a single little-endian sample.
+func (f wavFormat) sample(b []byte) float64 {
+	le := binary.LittleEndian
+	if f.formatTag == wavFormatIEEEFloat {
+		if f.bitsPerSample == 64 {
+			return math.Float64frombits(le.Uint64(b))
+		}
+		return float64(math.Float32frombits(le.Uint32(b)))
+	}
+
+	switch f.bitsPerSample {
+	case 8:
+		// 8-bit PCM is unsigned.
+		return (float64(b[0]) - 128) / 128.0
+	case 16:
+		return float64(int16(le.Uint16(b))) / 32768.0
+	case 24:
+		v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+		return float64(v) / 8388608.0
+	default:
+		return float64(int32(le.Uint32(b))) / 2147483648.0
+	}
+}
+
+// countingReader tracks the offset so errors can point at the bad chunk.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,58 @@
+//go:build js && wasm
+
+// Command wasm is the fingerprinter the web client runs in the browser. It
+// is built into the client's public folder with
+//
+//	GOOS=js GOARCH=wasm go build -o ../client/public/fingerprint.wasm ./wasm
+//
+// and must be rebuilt whenever the fingerprinting in package process or
+// its default config changes.
+package main
+
+import (
+	waveid "shazam/process"
+	"shazam/types"
+	"syscall/js"
+)
+
+// generateFingerprint fingerprints the samples of one channel, passed as an
+// array of numbers, at the sample rate given as the second argument. It
+// returns {error: 0, data, configId} with data the {address, anchorTime}
+// hashes and configId the config they were made with, or {error: 1, data}
+// with data the error message.
+func generateFingerprint(this js.Value, args []js.Value) any {
+	if len(args) < 2 {
+		return failure("expected audio samples and a sample rate")
+	}
+
+	cfg := waveid.DefaultConfig()
+	fp, err := waveid.NewStreamFingerprinter(args[1].Int(), cfg)
+	if err != nil {
+		return failure(err.Error())
+	}
+	data := []any{}
+	fp.OnHash = func(hash types.Hash) {
+		data = append(data, map[string]any{
+			"address":    hash.Address,
+			"anchorTime": hash.AnchorTimeMs,
+		})
+	}
+
+	samples := make([]float64, args[0].Length())
+	for i := range samples {
+		samples[i] = args[0].Index(i).Float()
+	}
+	fp.Write(samples)
+	fp.Close()
+
+	return js.ValueOf(map[string]any{"error": 0, "data": data, "configId": cfg.ID()})
+}
+
+func failure(message string) js.Value {
+	return js.ValueOf(map[string]any{"error": 1, "data": message})
+}
+
+func main() {
+	js.Global().Set("generateFingerprint", js.FuncOf(generateFingerprint))
+	select {}
+}